@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/laenzlinger/go-midi-rtp/midi"
 	"github.com/laenzlinger/go-midi-rtp/rtp"
 	"github.com/laenzlinger/go-midi-rtp/session"
 
@@ -24,12 +26,16 @@ func main() {
 	}
 	defer server.Shutdown()
 
-	s := session.Start(bonjourName, uint16(port))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := session.Start(ctx, bonjourName, uint16(port))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	msg := make(chan rune, 1)
-	sig := make(chan os.Signal, 1)
 
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		reader := bufio.NewReader(os.Stdin)
 		for {
@@ -45,7 +51,7 @@ func main() {
 	run := true
 	for run {
 		select {
-		case <-sig:
+		case <-ctx.Done():
 			run = false
 		case <-msg:
 			mcs := rtp.MIDICommands{
@@ -55,22 +61,26 @@ func main() {
 					// On the first command, Delta Time should not be needed but it seems
 					// that the Apple Midi Network Driver ignores all delta times
 					// in case the Z-flag is not set.
-					{Payload: []byte{0x96, 0x3c, 0x4f}, DeltaTime: time.Millisecond},
-					{Payload: []byte{0x86, 0x3c, 0x00}, DeltaTime: 500 * time.Millisecond},
-					{Payload: []byte{0x96, 0x40, 0x5f}},
-					{Payload: []byte{0x86, 0x40, 0x00}, DeltaTime: 500 * time.Millisecond},
-					{Payload: []byte{0x96, 0x43, 0x6f}},
-					{Payload: []byte{0x86, 0x43, 0x00}, DeltaTime: 500 * time.Millisecond},
-					{Payload: []byte{0x96, 0x48, 0x7f}},
-					{Payload: []byte{0x86, 0x48, 0x00}, DeltaTime: time.Second},
+					midi.Command(midi.NoteOn{Channel: 6, Key: 0x3c, Velocity: 0x4f}, time.Millisecond),
+					midi.Command(midi.NoteOff{Channel: 6, Key: 0x3c}, 500*time.Millisecond),
+					midi.Command(midi.NoteOn{Channel: 6, Key: 0x40, Velocity: 0x5f}, 0),
+					midi.Command(midi.NoteOff{Channel: 6, Key: 0x40}, 500*time.Millisecond),
+					midi.Command(midi.NoteOn{Channel: 6, Key: 0x43, Velocity: 0x6f}, 0),
+					midi.Command(midi.NoteOff{Channel: 6, Key: 0x43}, 500*time.Millisecond),
+					midi.Command(midi.NoteOn{Channel: 6, Key: 0x48, Velocity: 0x7f}, 0),
+					midi.Command(midi.NoteOff{Channel: 6, Key: 0x48}, time.Second),
 				},
 			}
 
-			s.SendMIDICommands(mcs)
+			if err := s.SendMIDICommands(mcs); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 
 	log.Println("Shutting down.")
-	s.End()
+	if err := s.Close(); err != nil {
+		log.Println(err)
+	}
 
 }
@@ -0,0 +1,400 @@
+package midi
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+// Message is a MIDI message which can be sent as the payload of a rtp.MIDICommand.
+type Message interface {
+	// Payload returns the encoded MIDI message.
+	Payload() rtp.MIDIPayload
+}
+
+// Errors returned by the constructors and by Parse
+var (
+	// ErrInvalidChannel is returned for channels outside of 0-15.
+	ErrInvalidChannel = errors.New("invalid MIDI channel")
+	// ErrInvalidData is returned for data octets outside of 0-127.
+	ErrInvalidData = errors.New("invalid MIDI data octet")
+	// ErrInvalidLength is returned when the payload length does not match the status.
+	ErrInvalidLength = errors.New("invalid MIDI message length")
+	// ErrUnsupportedStatus is returned for payloads which do not start with a known status.
+	ErrUnsupportedStatus = errors.New("unsupported MIDI status")
+)
+
+// MIDI status octets
+const (
+	noteOff           = 0x80
+	noteOn            = 0x90
+	polyAftertouch    = 0xa0
+	controlChange     = 0xb0
+	programChange     = 0xc0
+	channelAftertouch = 0xd0
+	pitchBend         = 0xe0
+	sysExStart        = 0xf0
+	timeCodeQuarter   = 0xf1
+	songPosition      = 0xf2
+	songSelect        = 0xf3
+	undefinedF4       = 0xf4
+	undefinedF5       = 0xf5
+	tuneRequest       = 0xf6
+	sysExEnd          = 0xf7
+	statusMask        = 0xf0
+	channelMask       = 0x0f
+	dataMask          = 0x7f
+	pitchBendCenter   = 0x2000
+)
+
+// NoteOn starts a note. A NoteOn with velocity 0 is equivalent to a NoteOff.
+type NoteOn struct {
+	Channel  uint8
+	Key      uint8
+	Velocity uint8
+}
+
+// NoteOff stops a note.
+type NoteOff struct {
+	Channel  uint8
+	Key      uint8
+	Velocity uint8
+}
+
+// PolyAftertouch changes the pressure of a single note.
+type PolyAftertouch struct {
+	Channel  uint8
+	Key      uint8
+	Pressure uint8
+}
+
+// ControlChange changes the value of a controller.
+type ControlChange struct {
+	Channel    uint8
+	Controller uint8
+	Value      uint8
+}
+
+// ProgramChange selects a program.
+type ProgramChange struct {
+	Channel uint8
+	Program uint8
+}
+
+// ChannelAftertouch changes the pressure of all notes of a channel.
+type ChannelAftertouch struct {
+	Channel  uint8
+	Pressure uint8
+}
+
+// PitchBend changes the pitch wheel. The Value is between -8192 and 8191, 0 is the center.
+type PitchBend struct {
+	Channel uint8
+	Value   int16
+}
+
+// SysEx is a complete System Exclusive message.
+type SysEx struct {
+	// Data contains the octets between 0xF0 and 0xF7.
+	Data []byte
+}
+
+// TimeCodeQuarterFrame is a MIDI Time Code quarter frame message.
+type TimeCodeQuarterFrame struct {
+	Piece uint8 // 0-7
+	Value uint8 // 0-15
+}
+
+// SongPositionPointer sets the song position in beats (16th notes).
+type SongPositionPointer struct {
+	Position uint16 // 0-16383
+}
+
+// SongSelect selects a song.
+type SongSelect struct {
+	Song uint8
+}
+
+// TuneRequest requests analog synthesizers to tune their oscillators.
+type TuneRequest struct{}
+
+// UndefinedCommon is one of the undefined System Common messages 0xF4 and 0xF5.
+type UndefinedCommon struct {
+	Status uint8
+}
+
+// RealTime is a single octet System Real-time message.
+type RealTime uint8
+
+// System Real-time messages
+const (
+	TimingClock RealTime = 0xf8
+	UndefinedF9 RealTime = 0xf9
+	Start       RealTime = 0xfa
+	Continue    RealTime = 0xfb
+	Stop        RealTime = 0xfc
+	UndefinedFD RealTime = 0xfd
+	ActiveSense RealTime = 0xfe
+	Reset       RealTime = 0xff
+)
+
+// NewNoteOn creates a validated NoteOn.
+func NewNoteOn(channel, key, velocity uint8) (NoteOn, error) {
+	if err := validate(channel, key, velocity); err != nil {
+		return NoteOn{}, err
+	}
+	return NoteOn{channel, key, velocity}, nil
+}
+
+// NewNoteOff creates a validated NoteOff.
+func NewNoteOff(channel, key, velocity uint8) (NoteOff, error) {
+	if err := validate(channel, key, velocity); err != nil {
+		return NoteOff{}, err
+	}
+	return NoteOff{channel, key, velocity}, nil
+}
+
+// NewPolyAftertouch creates a validated PolyAftertouch.
+func NewPolyAftertouch(channel, key, pressure uint8) (PolyAftertouch, error) {
+	if err := validate(channel, key, pressure); err != nil {
+		return PolyAftertouch{}, err
+	}
+	return PolyAftertouch{channel, key, pressure}, nil
+}
+
+// NewControlChange creates a validated ControlChange.
+func NewControlChange(channel, controller, value uint8) (ControlChange, error) {
+	if err := validate(channel, controller, value); err != nil {
+		return ControlChange{}, err
+	}
+	return ControlChange{channel, controller, value}, nil
+}
+
+// NewProgramChange creates a validated ProgramChange.
+func NewProgramChange(channel, program uint8) (ProgramChange, error) {
+	if err := validate(channel, program); err != nil {
+		return ProgramChange{}, err
+	}
+	return ProgramChange{channel, program}, nil
+}
+
+// NewChannelAftertouch creates a validated ChannelAftertouch.
+func NewChannelAftertouch(channel, pressure uint8) (ChannelAftertouch, error) {
+	if err := validate(channel, pressure); err != nil {
+		return ChannelAftertouch{}, err
+	}
+	return ChannelAftertouch{channel, pressure}, nil
+}
+
+// NewPitchBend creates a validated PitchBend.
+func NewPitchBend(channel uint8, value int16) (PitchBend, error) {
+	if value < -pitchBendCenter || value >= pitchBendCenter {
+		return PitchBend{}, fmt.Errorf("%w: pitch bend %d", ErrInvalidData, value)
+	}
+	if err := validate(channel); err != nil {
+		return PitchBend{}, err
+	}
+	return PitchBend{channel, value}, nil
+}
+
+// NewSysEx creates a validated SysEx with the data between 0xF0 and 0xF7.
+func NewSysEx(data []byte) (SysEx, error) {
+	if err := validateData(data...); err != nil {
+		return SysEx{}, err
+	}
+	return SysEx{data}, nil
+}
+
+// NewTimeCodeQuarterFrame creates a validated TimeCodeQuarterFrame.
+func NewTimeCodeQuarterFrame(piece, value uint8) (TimeCodeQuarterFrame, error) {
+	if piece > 7 || value > 15 {
+		return TimeCodeQuarterFrame{}, fmt.Errorf("%w: quarter frame %d/%d", ErrInvalidData, piece, value)
+	}
+	return TimeCodeQuarterFrame{piece, value}, nil
+}
+
+// NewSongPositionPointer creates a validated SongPositionPointer.
+func NewSongPositionPointer(position uint16) (SongPositionPointer, error) {
+	if position > 0x3fff {
+		return SongPositionPointer{}, fmt.Errorf("%w: song position %d", ErrInvalidData, position)
+	}
+	return SongPositionPointer{position}, nil
+}
+
+// NewSongSelect creates a validated SongSelect.
+func NewSongSelect(song uint8) (SongSelect, error) {
+	if err := validateData(song); err != nil {
+		return SongSelect{}, err
+	}
+	return SongSelect{song}, nil
+}
+
+func validate(channel uint8, data ...uint8) error {
+	if channel > channelMask {
+		return fmt.Errorf("%w: %d", ErrInvalidChannel, channel)
+	}
+	return validateData(data...)
+}
+
+func validateData(data ...uint8) error {
+	for _, d := range data {
+		if d > dataMask {
+			return fmt.Errorf("%w: 0x%x", ErrInvalidData, d)
+		}
+	}
+	return nil
+}
+
+// Payload returns the encoded message
+func (m NoteOn) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{noteOn | m.Channel&channelMask, m.Key & dataMask, m.Velocity & dataMask}
+}
+
+// Payload returns the encoded message
+func (m NoteOff) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{noteOff | m.Channel&channelMask, m.Key & dataMask, m.Velocity & dataMask}
+}
+
+// Payload returns the encoded message
+func (m PolyAftertouch) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{polyAftertouch | m.Channel&channelMask, m.Key & dataMask, m.Pressure & dataMask}
+}
+
+// Payload returns the encoded message
+func (m ControlChange) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{controlChange | m.Channel&channelMask, m.Controller & dataMask, m.Value & dataMask}
+}
+
+// Payload returns the encoded message
+func (m ProgramChange) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{programChange | m.Channel&channelMask, m.Program & dataMask}
+}
+
+// Payload returns the encoded message
+func (m ChannelAftertouch) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{channelAftertouch | m.Channel&channelMask, m.Pressure & dataMask}
+}
+
+// Payload returns the encoded message
+func (m PitchBend) Payload() rtp.MIDIPayload {
+	value := uint16(int(m.Value) + pitchBendCenter)
+	return rtp.MIDIPayload{pitchBend | m.Channel&channelMask, byte(value) & dataMask, byte(value>>7) & dataMask}
+}
+
+// Payload returns the encoded message
+func (m SysEx) Payload() rtp.MIDIPayload {
+	return append(append(rtp.MIDIPayload{sysExStart}, m.Data...), sysExEnd)
+}
+
+// Payload returns the encoded message
+func (m TimeCodeQuarterFrame) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{timeCodeQuarter, (m.Piece&0x07)<<4 | m.Value&0x0f}
+}
+
+// Payload returns the encoded message
+func (m SongPositionPointer) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{songPosition, byte(m.Position) & dataMask, byte(m.Position>>7) & dataMask}
+}
+
+// Payload returns the encoded message
+func (m SongSelect) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{songSelect, m.Song & dataMask}
+}
+
+// Payload returns the encoded message
+func (m TuneRequest) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{tuneRequest}
+}
+
+// Payload returns the encoded message
+func (m UndefinedCommon) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{m.Status}
+}
+
+// Payload returns the encoded message
+func (m RealTime) Payload() rtp.MIDIPayload {
+	return rtp.MIDIPayload{byte(m)}
+}
+
+// Parse decodes a complete MIDI message. SysEx segments are not accepted,
+// see rtp.SysExAssembler.
+func Parse(p rtp.MIDIPayload) (Message, error) {
+	if len(p) == 0 {
+		return nil, fmt.Errorf("%w: empty payload", ErrInvalidLength)
+	}
+	status := p[0]
+	if status < noteOff {
+		return nil, fmt.Errorf("%w: 0x%x", ErrUnsupportedStatus, status)
+	}
+	if status == sysExStart {
+		if len(p) < 2 || p[len(p)-1] != sysExEnd {
+			return nil, fmt.Errorf("%w: SysEx without end", ErrInvalidLength)
+		}
+		data := p[1 : len(p)-1]
+		if err := validateData(data...); err != nil {
+			return nil, err
+		}
+		return SysEx{Data: append([]byte{}, data...)}, nil
+	}
+	if len(p) != length(status) {
+		return nil, fmt.Errorf("%w: %d octets for status 0x%x", ErrInvalidLength, len(p), status)
+	}
+	if err := validateData(p[1:]...); err != nil {
+		return nil, err
+	}
+	channel := status & channelMask
+	switch status & statusMask {
+	case noteOff:
+		return NoteOff{channel, p[1], p[2]}, nil
+	case noteOn:
+		return NoteOn{channel, p[1], p[2]}, nil
+	case polyAftertouch:
+		return PolyAftertouch{channel, p[1], p[2]}, nil
+	case controlChange:
+		return ControlChange{channel, p[1], p[2]}, nil
+	case programChange:
+		return ProgramChange{channel, p[1]}, nil
+	case channelAftertouch:
+		return ChannelAftertouch{channel, p[1]}, nil
+	case pitchBend:
+		return PitchBend{channel, int16(int(p[1])|int(p[2])<<7) - pitchBendCenter}, nil
+	}
+	switch status {
+	case timeCodeQuarter:
+		return TimeCodeQuarterFrame{p[1] >> 4, p[1] & 0x0f}, nil
+	case songPosition:
+		return SongPositionPointer{uint16(p[1]) | uint16(p[2])<<7}, nil
+	case songSelect:
+		return SongSelect{p[1]}, nil
+	case undefinedF4, undefinedF5:
+		return UndefinedCommon{status}, nil
+	case tuneRequest:
+		return TuneRequest{}, nil
+	case sysExEnd:
+		return nil, fmt.Errorf("%w: SysEx segment", ErrUnsupportedStatus)
+	}
+	return RealTime(status), nil
+}
+
+// length returns the length of the message with the given status, except SysEx.
+func length(status uint8) int {
+	switch {
+	case status >= programChange && status < pitchBend, status == timeCodeQuarter, status == songSelect:
+		return 2
+	case status < sysExStart, status == songPosition:
+		return 3
+	}
+	return 1
+}
+
+// Command returns the rtp.MIDICommand of the message with the given delta time.
+func Command(m Message, delta time.Duration) rtp.MIDICommand {
+	return rtp.MIDICommand{DeltaTime: delta, Payload: m.Payload()}
+}
+
+// FromCommand parses the payload of the rtp.MIDICommand.
+func FromCommand(mc rtp.MIDICommand) (Message, error) {
+	return Parse(mc.Payload)
+}
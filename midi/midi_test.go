@@ -0,0 +1,91 @@
+package midi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parse_of_payload(t *testing.T) {
+	tests := []struct {
+		payload  rtp.MIDIPayload
+		expected Message
+	}{
+		{rtp.MIDIPayload{0x96, 0x3c, 0x4f}, NoteOn{Channel: 6, Key: 0x3c, Velocity: 0x4f}},
+		{rtp.MIDIPayload{0x86, 0x3c, 0x00}, NoteOff{Channel: 6, Key: 0x3c}},
+		{rtp.MIDIPayload{0xa1, 0x3c, 0x20}, PolyAftertouch{Channel: 1, Key: 0x3c, Pressure: 0x20}},
+		{rtp.MIDIPayload{0xb2, 0x07, 0x64}, ControlChange{Channel: 2, Controller: 7, Value: 0x64}},
+		{rtp.MIDIPayload{0xc3, 0x05}, ProgramChange{Channel: 3, Program: 5}},
+		{rtp.MIDIPayload{0xd4, 0x30}, ChannelAftertouch{Channel: 4, Pressure: 0x30}},
+		{rtp.MIDIPayload{0xe5, 0x00, 0x40}, PitchBend{Channel: 5, Value: 0}},
+		{rtp.MIDIPayload{0xe5, 0x00, 0x00}, PitchBend{Channel: 5, Value: -8192}},
+		{rtp.MIDIPayload{0xe5, 0x7f, 0x7f}, PitchBend{Channel: 5, Value: 8191}},
+		{rtp.MIDIPayload{0xf0, 0x7e, 0x01, 0xf7}, SysEx{Data: []byte{0x7e, 0x01}}},
+		{rtp.MIDIPayload{0xf1, 0x35}, TimeCodeQuarterFrame{Piece: 3, Value: 5}},
+		{rtp.MIDIPayload{0xf2, 0x01, 0x02}, SongPositionPointer{Position: 0x101}},
+		{rtp.MIDIPayload{0xf3, 0x07}, SongSelect{Song: 7}},
+		{rtp.MIDIPayload{0xf5}, UndefinedCommon{Status: 0xf5}},
+		{rtp.MIDIPayload{0xf6}, TuneRequest{}},
+		{rtp.MIDIPayload{0xf8}, TimingClock},
+		{rtp.MIDIPayload{0xff}, Reset},
+	}
+	for _, test := range tests {
+		// when
+		actual, err := Parse(test.payload)
+		// then
+		assert.Nil(t, err, "%x", test.payload)
+		assert.Equal(t, test.expected, actual)
+		assert.Equal(t, test.payload, actual.Payload())
+	}
+}
+
+func Test_parse_errors(t *testing.T) {
+	tests := []struct {
+		payload  rtp.MIDIPayload
+		expected error
+	}{
+		{rtp.MIDIPayload{}, ErrInvalidLength},
+		{rtp.MIDIPayload{0x3c, 0x40}, ErrUnsupportedStatus},
+		{rtp.MIDIPayload{0x90, 0x3c}, ErrInvalidLength},
+		{rtp.MIDIPayload{0x90, 0x3c, 0x80}, ErrInvalidData},
+		{rtp.MIDIPayload{0xf0, 0x01}, ErrInvalidLength},
+		{rtp.MIDIPayload{0xf7, 0x01, 0xf7}, ErrInvalidLength},
+	}
+	for _, test := range tests {
+		// when
+		_, err := Parse(test.payload)
+		// then
+		assert.True(t, errors.Is(err, test.expected), "%x: %v", test.payload, err)
+	}
+}
+
+func Test_constructors_validate(t *testing.T) {
+	// when
+	_, channel := NewNoteOn(16, 0x3c, 0x40)
+	_, data := NewControlChange(0, 0x80, 0)
+	_, bend := NewPitchBend(0, 8192)
+	_, sysex := NewSysEx([]byte{0x01, 0xf7})
+	on, err := NewNoteOn(0, 0x3c, 0x40)
+	// then
+	assert.True(t, errors.Is(channel, ErrInvalidChannel))
+	assert.True(t, errors.Is(data, ErrInvalidData))
+	assert.True(t, errors.Is(bend, ErrInvalidData))
+	assert.True(t, errors.Is(sysex, ErrInvalidData))
+	assert.Nil(t, err)
+	assert.Equal(t, NoteOn{Key: 0x3c, Velocity: 0x40}, on)
+}
+
+func Test_conversion_of_command(t *testing.T) {
+	// given
+	m := ProgramChange{Channel: 1, Program: 2}
+	// when
+	mc := Command(m, time.Millisecond)
+	actual, err := FromCommand(mc)
+	// then
+	assert.Equal(t, rtp.MIDICommand{DeltaTime: time.Millisecond, Payload: rtp.MIDIPayload{0xc1, 0x02}}, mc)
+	assert.Nil(t, err)
+	assert.Equal(t, m, actual)
+}
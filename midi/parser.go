@@ -0,0 +1,156 @@
+package midi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+const realTimeStart = 0xf8
+
+// DefaultMaxSysExLength is the maximum length of a SysEx message including the
+// start and end octet, used when Parser.MaxSysExLength is 0.
+const DefaultMaxSysExLength = 64 * 1024
+
+// ErrSysExTooLong is returned by the Parser when a SysEx message exceeds the
+// maximum length. The message is discarded.
+var ErrSysExTooLong = errors.New("SysEx message too long")
+
+// Parser splits a raw MIDI byte stream, as read from a serial DIN port or a
+// file, into complete MIDI payloads.
+//
+// Running status is expanded, so every returned payload starts with its status
+// octet and can be passed to Parse. Real-time octets are returned as soon as
+// they are seen, also when they are interleaved within another message.
+// Data octets without a status and SysEx messages which are interrupted by
+// another status are discarded.
+type Parser struct {
+	// MaxSysExLength limits the length of a SysEx message, see DefaultMaxSysExLength.
+	MaxSysExLength int
+	running        uint8 // running status of the channel voice messages
+	pending        []byte
+	sysEx          bool
+}
+
+// Parse feeds the bytes into the parser and returns the payloads which were
+// completed. Incomplete messages are kept until the next call.
+//
+// ErrSysExTooLong is returned together with the completed payloads when a SysEx
+// message exceeded the maximum length. The parser continues with the next status.
+func (p *Parser) Parse(data []byte) (payloads []rtp.MIDIPayload, err error) {
+	for _, b := range data {
+		payload, e := p.feed(b)
+		if payload != nil {
+			payloads = append(payloads, payload)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return payloads, err
+}
+
+// Reset discards the incomplete message and the running status.
+func (p *Parser) Reset() {
+	p.running = 0
+	p.pending = nil
+	p.sysEx = false
+}
+
+func (p *Parser) feed(b byte) (rtp.MIDIPayload, error) {
+	switch {
+	case b >= realTimeStart:
+		return rtp.MIDIPayload{b}, nil
+	case b == sysExStart:
+		p.running = 0
+		p.pending = []byte{b}
+		p.sysEx = true
+		return nil, nil
+	case b == sysExEnd:
+		if !p.sysEx {
+			p.running = 0
+			p.pending = nil
+			return nil, nil
+		}
+		return p.complete(b), nil
+	case b > dataMask:
+		p.sysEx = false
+		p.pending = []byte{b}
+		if b < sysExStart {
+			p.running = b
+		} else {
+			p.running = 0
+		}
+		if length(b) == 1 {
+			return p.complete(), nil
+		}
+		return nil, nil
+	case p.sysEx:
+		if len(p.pending)+1 >= p.maxSysExLength() {
+			p.Reset()
+			return nil, fmt.Errorf("%w: exceeds %d octets", ErrSysExTooLong, p.maxSysExLength())
+		}
+		p.pending = append(p.pending, b)
+		return nil, nil
+	case len(p.pending) == 0:
+		if p.running == 0 {
+			return nil, nil
+		}
+		p.pending = []byte{p.running}
+	}
+	p.pending = append(p.pending, b)
+	if len(p.pending) == length(p.pending[0]) {
+		return p.complete(), nil
+	}
+	return nil, nil
+}
+
+func (p *Parser) maxSysExLength() int {
+	if p.MaxSysExLength > 0 {
+		return p.MaxSysExLength
+	}
+	return DefaultMaxSysExLength
+}
+
+func (p *Parser) complete(b ...byte) rtp.MIDIPayload {
+	payload := rtp.MIDIPayload(append(p.pending, b...))
+	p.pending = nil
+	p.sysEx = false
+	return payload
+}
+
+// Reader reads complete MIDI payloads from a raw MIDI byte stream.
+type Reader struct {
+	r        io.Reader
+	parser   Parser
+	buf      []byte
+	payloads []rtp.MIDIPayload
+}
+
+// NewReader creates a new Reader which reads from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buf: make([]byte, 512)}
+}
+
+// ReadPayload returns the next complete MIDI payload. It returns the error of
+// the underlying reader, e.g. io.EOF, once no complete payload is left.
+// ErrSysExTooLong is returned when a SysEx message was discarded, the following
+// payloads can still be read.
+func (r *Reader) ReadPayload() (rtp.MIDIPayload, error) {
+	for len(r.payloads) == 0 {
+		n, err := r.r.Read(r.buf)
+		payloads, parseErr := r.parser.Parse(r.buf[:n])
+		r.payloads = payloads
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		if err != nil && len(r.payloads) == 0 {
+			return nil, err
+		}
+	}
+	payload := r.payloads[0]
+	r.payloads = r.payloads[1:]
+	return payload, nil
+}
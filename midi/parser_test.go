@@ -0,0 +1,117 @@
+package midi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parser_expands_running_status(t *testing.T) {
+	// given
+	p := Parser{}
+	// when
+	actual, _ := p.Parse([]byte{0x90, 0x3c, 0x40, 0x40, 0x40, 0xc1, 0x05, 0x06})
+	// then
+	assert.Equal(t, []rtp.MIDIPayload{
+		{0x90, 0x3c, 0x40},
+		{0x90, 0x40, 0x40},
+		{0xc1, 0x05},
+		{0xc1, 0x06},
+	}, actual)
+}
+
+func Test_parser_keeps_incomplete_messages(t *testing.T) {
+	// given
+	p := Parser{}
+	// when
+	first, _ := p.Parse([]byte{0xb0, 0x07})
+	second, _ := p.Parse([]byte{0x64, 0xf0, 0x7e})
+	third, _ := p.Parse([]byte{0x01, 0xf7})
+	// then
+	assert.Nil(t, first)
+	assert.Equal(t, []rtp.MIDIPayload{{0xb0, 0x07, 0x64}}, second)
+	assert.Equal(t, []rtp.MIDIPayload{{0xf0, 0x7e, 0x01, 0xf7}}, third)
+}
+
+func Test_parser_returns_interleaved_real_time(t *testing.T) {
+	// given
+	p := Parser{}
+	// when
+	actual, _ := p.Parse([]byte{0xf0, 0x01, 0xf8, 0x02, 0xf7, 0x90, 0x3c, 0xfe, 0x40})
+	// then
+	assert.Equal(t, []rtp.MIDIPayload{
+		{0xf8},
+		{0xf0, 0x01, 0x02, 0xf7},
+		{0xfe},
+		{0x90, 0x3c, 0x40},
+	}, actual)
+}
+
+func Test_parser_discards_invalid_bytes(t *testing.T) {
+	// given
+	p := Parser{}
+	// when
+	actual, _ := p.Parse([]byte{
+		0x3c, 0x40, // data without status
+		0xf0, 0x01, 0xf6, // SysEx interrupted by tune request
+		0x40,             // running status cancelled by system common
+		0x90, 0x3c, 0xf7, // stray SysEx end
+		0xf2, 0x01, 0x02,
+	})
+	// then
+	assert.Equal(t, []rtp.MIDIPayload{{0xf6}, {0xf2, 0x01, 0x02}}, actual)
+	for _, payload := range actual {
+		_, err := Parse(payload)
+		assert.Nil(t, err)
+	}
+}
+
+func Test_reader_reads_payloads(t *testing.T) {
+	// given
+	r := NewReader(bytes.NewReader([]byte{0x90, 0x3c, 0x40, 0x3c, 0x00, 0x90}))
+	// when
+	first, err1 := r.ReadPayload()
+	second, err2 := r.ReadPayload()
+	_, err3 := r.ReadPayload()
+	// then
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, rtp.MIDIPayload{0x90, 0x3c, 0x40}, first)
+	assert.Equal(t, rtp.MIDIPayload{0x90, 0x3c, 0x00}, second)
+	assert.Equal(t, io.EOF, err3)
+}
+
+func Test_parser_discards_too_long_sysex(t *testing.T) {
+	// given
+	p := Parser{MaxSysExLength: 4}
+	// when
+	fits, err1 := p.Parse([]byte{0xf0, 0x01, 0x02, 0xf7})
+	tooLong, err2 := p.Parse([]byte{0xf0, 0x01, 0x02, 0x03, 0x04, 0xf7, 0x90, 0x3c, 0x40})
+	// then
+	assert.Nil(t, err1)
+	assert.Equal(t, []rtp.MIDIPayload{{0xf0, 0x01, 0x02, 0xf7}}, fits)
+	assert.True(t, errors.Is(err2, ErrSysExTooLong))
+	assert.Equal(t, []rtp.MIDIPayload{{0x90, 0x3c, 0x40}}, tooLong)
+	assert.Nil(t, p.pending)
+}
+
+func Test_reader_reports_too_long_sysex(t *testing.T) {
+	// given
+	data := append([]byte{0xf0}, make([]byte, DefaultMaxSysExLength)...)
+	data = append(data, 0xf7, 0xfe)
+	r := NewReader(bytes.NewReader(data))
+	// when
+	var err error
+	for err == nil {
+		_, err = r.ReadPayload()
+	}
+	payload, next := r.ReadPayload()
+	// then
+	assert.True(t, errors.Is(err, ErrSysExTooLong))
+	assert.Nil(t, next)
+	assert.Equal(t, rtp.MIDIPayload{0xfe}, payload)
+}
@@ -0,0 +1,257 @@
+package netsim
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/session"
+)
+
+// maxHoldTime is the time after which a packet held back for reordering is
+// delivered when no further packet is sent on its link.
+const maxHoldTime = 50 * time.Millisecond
+
+// queueLength is the number of packets which can be in flight on a link.
+const queueLength = 1024
+
+// Impairment defines how the packets sent from one host to another are impaired.
+type Impairment struct {
+	// Loss is the probability that a packet is dropped.
+	Loss float64
+	// Duplication is the probability that a packet is delivered twice.
+	Duplication float64
+	// Reordering is the probability that a packet is held back and delivered
+	// after the next packet on the same link.
+	Reordering float64
+	// Latency is the delay of every packet.
+	Latency time.Duration
+	// Jitter is the maximum additional random delay of a packet. The packets on a
+	// link are still delivered in order, see Reordering.
+	Jitter time.Duration
+}
+
+// Stats counts the packets sent over the network.
+type Stats struct {
+	Sent       int
+	Lost       int
+	Duplicated int
+	Reordered  int
+}
+
+// Network is a simulated packet network between the sessions of its transports.
+// The packets are delivered in memory, see session.MemoryNetwork, and impaired
+// on the way.
+//
+// The random decisions are taken per link, from one IP address to another, with
+// a generator derived from the seed. The same sequence of packets on a link is
+// therefore always impaired the same way.
+type Network struct {
+	memory *session.MemoryNetwork
+	seed   int64
+	// mutex protects the fields below
+	mutex       sync.Mutex
+	impairment  Impairment
+	impairments map[link]Impairment
+	links       map[link]*linkState
+	stats       Stats
+	closed      bool
+}
+
+type link struct {
+	from, to string
+}
+
+type linkState struct {
+	rand *rand.Rand
+	held *packet
+	// deliveries are written in order by the go routine of the link.
+	deliveries chan delivery
+}
+
+type packet struct {
+	data []byte
+	to   net.Addr
+	pc   net.PacketConn
+}
+
+type delivery struct {
+	packets []*packet
+	due     time.Time
+}
+
+// New creates a network which impairs all links with the given impairment.
+func New(seed int64, impairment Impairment) *Network {
+	return &Network{
+		memory:      session.NewMemoryNetwork(),
+		seed:        seed,
+		impairment:  impairment,
+		impairments: map[link]Impairment{},
+		links:       map[link]*linkState{},
+	}
+}
+
+// Transport returns the transport of the host with the given IP address.
+func (n *Network) Transport(ip net.IP) session.Transport {
+	return transport{network: n, inner: n.memory.Transport(ip)}
+}
+
+// Impair sets the impairment of the packets sent from one host to another.
+// It can be changed at any time, e.g. to simulate an outage with a Loss of 1.
+func (n *Network) Impair(from, to net.IP, impairment Impairment) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.impairments[link{from.String(), to.String()}] = impairment
+}
+
+// Stats returns the number of packets sent and impaired so far.
+func (n *Network) Stats() Stats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stats
+}
+
+// Close stops the delivery of the packets. Packets sent afterwards are dropped.
+func (n *Network) Close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = true
+	for _, state := range n.links {
+		close(state.deliveries)
+	}
+}
+
+func (n *Network) link(l link) *linkState {
+	state, found := n.links[l]
+	if !found {
+		h := fnv.New64a()
+		h.Write([]byte(l.from + ">" + l.to))
+		state = &linkState{
+			rand:       rand.New(rand.NewSource(n.seed ^ int64(h.Sum64()))),
+			deliveries: make(chan delivery, queueLength),
+		}
+		n.links[l] = state
+		go deliver(state.deliveries)
+	}
+	return state
+}
+
+func (n *Network) send(from net.Addr, p *packet) {
+	l := link{ip(from), ip(p.to)}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return
+	}
+	impairment, found := n.impairments[l]
+	if !found {
+		impairment = n.impairment
+	}
+	state := n.link(l)
+	n.stats.Sent++
+	if state.rand.Float64() < impairment.Loss {
+		n.stats.Lost++
+		return
+	}
+	due := time.Now().Add(impairment.Latency)
+	if impairment.Jitter > 0 {
+		due = due.Add(time.Duration(state.rand.Int63n(int64(impairment.Jitter))))
+	}
+	if state.held == nil && state.rand.Float64() < impairment.Reordering {
+		n.stats.Reordered++
+		state.held = p
+		time.AfterFunc(maxHoldTime, func() { n.release(state, p, due) })
+		return
+	}
+	packets := []*packet{p}
+	if state.rand.Float64() < impairment.Duplication {
+		n.stats.Duplicated++
+		packets = append(packets, p)
+	}
+	if state.held != nil {
+		packets = append(packets, state.held)
+		state.held = nil
+	}
+	n.enqueue(state, delivery{packets: packets, due: due})
+}
+
+// release delivers the held packet if no further packet was sent on its link.
+func (n *Network) release(state *linkState, p *packet, due time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed || state.held != p {
+		return
+	}
+	state.held = nil
+	n.enqueue(state, delivery{packets: []*packet{p}, due: due})
+}
+
+// enqueue passes the packets to the go routine of the link. Like a router,
+// the packets are dropped when the queue is full.
+func (n *Network) enqueue(state *linkState, d delivery) {
+	select {
+	case state.deliveries <- d:
+	default:
+		n.stats.Lost += len(d.packets)
+	}
+}
+
+// deliver writes the packets in order once they are due.
+func deliver(deliveries chan delivery) {
+	for d := range deliveries {
+		time.Sleep(time.Until(d.due))
+		for _, p := range d.packets {
+			p.pc.WriteTo(p.data, p.to)
+		}
+	}
+}
+
+func ip(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+type transport struct {
+	network *Network
+	inner   session.Transport
+}
+
+func (t transport) ListenPacket(port uint16) (net.PacketConn, error) {
+	pc, err := t.inner.ListenPacket(port)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{PacketConn: pc, network: t.network}, nil
+}
+
+// conn impairs the packets written to the PacketConn of the memory network.
+type conn struct {
+	net.PacketConn
+	network *Network
+	closed  atomic.Bool
+}
+
+func (c *conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.closed.Load() {
+		return 0, &net.OpError{Op: "write", Net: "netsim", Addr: c.LocalAddr(), Err: net.ErrClosed}
+	}
+	c.network.send(c.LocalAddr(), &packet{data: append([]byte{}, b...), to: addr, pc: c.PacketConn})
+	return len(b), nil
+}
+
+func (c *conn) Close() error {
+	c.closed.Store(true)
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,114 @@
+package netsim
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	hostA = net.IPv4(10, 0, 0, 1)
+	hostB = net.IPv4(10, 0, 0, 2)
+)
+
+// transfer sends the numbered packets from host A to host B and returns the received numbers.
+func transfer(n *Network, count int) []byte {
+	a, _ := n.Transport(hostA).ListenPacket(5004)
+	defer a.Close()
+	b, _ := n.Transport(hostB).ListenPacket(5004)
+	defer b.Close()
+	for i := 0; i < count; i++ {
+		a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	received := []byte{}
+	buffer := make([]byte, 10)
+	for {
+		b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err := b.ReadFrom(buffer)
+		if err != nil {
+			return received
+		}
+		received = append(received, buffer[0])
+	}
+}
+
+func Test_impairment_is_deterministic(t *testing.T) {
+	// given
+	impairment := Impairment{Loss: 0.2, Duplication: 0.1, Reordering: 0.1}
+	first, second, other := New(42, impairment), New(42, impairment), New(7, impairment)
+	defer first.Close()
+	defer second.Close()
+	defer other.Close()
+	// when
+	received := transfer(first, 100)
+	again := transfer(second, 100)
+	different := transfer(other, 100)
+	// then
+	assert.Equal(t, received, again)
+	assert.NotEqual(t, received, different)
+	stats := first.Stats()
+	assert.Equal(t, 100, stats.Sent)
+	assert.Equal(t, 100-stats.Lost+stats.Duplicated, len(received))
+	assert.True(t, stats.Lost > 0 && stats.Duplicated > 0 && stats.Reordered > 0)
+}
+
+func Test_duplication(t *testing.T) {
+	// given
+	n := New(1, Impairment{Duplication: 1})
+	defer n.Close()
+	// when
+	received := transfer(n, 2)
+	// then
+	assert.Equal(t, []byte{0, 0, 1, 1}, received)
+}
+
+func Test_reordering(t *testing.T) {
+	// given
+	n := New(1, Impairment{Reordering: 1})
+	defer n.Close()
+	// when
+	received := transfer(n, 3)
+	// then
+	assert.Equal(t, []byte{1, 0, 2}, received)
+}
+
+func Test_latency_and_jitter(t *testing.T) {
+	// given
+	n := New(1, Impairment{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	defer n.Close()
+	a, _ := n.Transport(hostA).ListenPacket(5004)
+	defer a.Close()
+	b, _ := n.Transport(hostB).ListenPacket(5004)
+	defer b.Close()
+	// when
+	sent := time.Now()
+	a.WriteTo([]byte{1}, b.LocalAddr())
+	_, from, err := b.ReadFrom(make([]byte, 10))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, a.LocalAddr(), from)
+	assert.True(t, time.Since(sent) >= 20*time.Millisecond)
+}
+
+func Test_links_are_impaired_independently(t *testing.T) {
+	// given
+	n := New(1, Impairment{})
+	defer n.Close()
+	n.Impair(hostA, hostB, Impairment{Loss: 1})
+	a, _ := n.Transport(hostA).ListenPacket(5004)
+	defer a.Close()
+	b, _ := n.Transport(hostB).ListenPacket(5004)
+	defer b.Close()
+	// when
+	a.WriteTo([]byte{1}, b.LocalAddr())
+	b.WriteTo([]byte{2}, a.LocalAddr())
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, lost := b.ReadFrom(make([]byte, 10))
+	_, _, err := a.ReadFrom(make([]byte, 10))
+	// then
+	assert.NotNil(t, lost)
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{Sent: 2, Lost: 1}, n.Stats())
+}
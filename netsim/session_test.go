@@ -0,0 +1,109 @@
+package netsim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/laenzlinger/go-midi-rtp/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// connect starts the sessions on host A and B and invites B from A.
+func connect(t *testing.T, n *Network, optsA, optsB []session.Option) (a, b *session.MIDINetworkSession, conn *session.MIDINetworkStream) {
+	ctx := context.Background()
+	a, err := session.Start(ctx, "a", 5004, append(optsA, session.WithTransport(n.Transport(hostA)))...)
+	assert.Nil(t, err)
+	b, err = session.Start(ctx, "b", 5004, append(optsB, session.WithTransport(n.Transport(hostB)))...)
+	assert.Nil(t, err)
+	conn, err = a.Invite(ctx, &net.UDPAddr{IP: hostB, Port: 5004})
+	assert.Nil(t, err)
+	return
+}
+
+func Test_lost_commands_are_recovered_from_the_journal(t *testing.T) {
+	// given
+	n := New(1, Impairment{})
+	defer n.Close()
+	a, b, _ := connect(t, n, nil, nil)
+	defer a.Close()
+	defer b.Close()
+	received := make(chan rtp.MIDICommands, 10)
+	b.HandleMIDI(func(conn *session.MIDINetworkStream, mcs rtp.MIDICommands) {
+		received <- mcs
+	})
+	a.SendMIDIPayload([]byte{0xc0, 0x01})
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "first MIDI message not received")
+	}
+	// when
+	n.Impair(hostA, hostB, Impairment{Loss: 1})
+	a.SendMIDIPayload([]byte{0x90, 0x3c, 0x40})
+	n.Impair(hostA, hostB, Impairment{})
+	a.SendMIDIPayload([]byte{0xb0, 0x07, 0x64})
+	// then
+	select {
+	case mcs := <-received:
+		payloads := []rtp.MIDIPayload{}
+		for _, mc := range mcs.Commands {
+			payloads = append(payloads, mc.Payload)
+		}
+		assert.Contains(t, payloads, rtp.MIDIPayload{0x90, 0x3c, 0x40})
+		assert.Equal(t, rtp.MIDIPayload{0xb0, 0x07, 0x64}, payloads[len(payloads)-1])
+	case <-time.After(time.Second):
+		assert.Fail(t, "MIDI message not received")
+	}
+}
+
+func Test_clock_offset_is_estimated_with_latency(t *testing.T) {
+	// given
+	impairment := Impairment{Latency: 10 * time.Millisecond, Jitter: 2 * time.Millisecond}
+	n := New(1, impairment)
+	defer n.Close()
+	schedule := session.WithSyncSchedule(session.SyncSchedule{BurstCount: 3, BurstInterval: 50 * time.Millisecond, Interval: time.Second})
+	a, b, conn := connect(t, n, []session.Option{schedule}, nil)
+	defer a.Close()
+	defer b.Close()
+	// when
+	for i := 0; i < 100 && conn.Latency() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// then
+	// A packet is delayed by the latency, the jitter and the scheduling of the
+	// go routines, which is allowed to take twice the latency. The estimated
+	// offset is off by half the difference of the delays in both directions.
+	maxDelay := impairment.Latency + impairment.Jitter + 2*impairment.Latency
+	tolerance := (maxDelay - impairment.Latency) / 2
+	assert.True(t, conn.Latency() >= 2*impairment.Latency, "latency %v", conn.Latency())
+	assert.True(t, conn.Latency() <= 2*maxDelay, "latency %v", conn.Latency())
+	deviation := conn.ClockOffset() - a.StartTime.Sub(b.StartTime)
+	assert.True(t, deviation >= -tolerance && deviation <= tolerance, "deviation %v, tolerance %v", deviation, tolerance)
+}
+
+func Test_silent_peer_times_out(t *testing.T) {
+	// given
+	n := New(1, Impairment{})
+	defer n.Close()
+	a, b, _ := connect(t, n, nil, []session.Option{session.WithPeerTimeout(200 * time.Millisecond)})
+	defer a.Close()
+	defer b.Close()
+	ended := make(chan error, 1)
+	b.HandleEnd(func(conn *session.MIDINetworkStream, reason error) {
+		ended <- reason
+	})
+	// when
+	n.Impair(hostA, hostB, Impairment{Loss: 1})
+	n.Impair(hostB, hostA, Impairment{Loss: 1})
+	// then
+	select {
+	case reason := <-ended:
+		assert.True(t, errors.Is(reason, session.ErrPeerTimeout))
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "stream not removed")
+	}
+}
@@ -1,14 +1,35 @@
 package recoveryjournal
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
 // ChannelJournal contains the top level hierarchy for all channels.
 type ChannelJournal struct {
-    // Channels contains channel journal state. Index is MIDI channel. (0-15)
+	// Channels contains channel journal state. Index is MIDI channel. (0-15)
 	Channels map[uint8]Chapters
 }
 
 // Chapters contains the chapters for a channel.
 type Chapters struct {
-	ChapterN[] ChapterN
+	// SinglePacketLoss is false if the chapters contain commands of the previous packet.
+	SinglePacketLoss bool
+	// EnhancedChapterC is true if Chapter C uses the enhanced encoding.
+	EnhancedChapterC bool
+	ChapterP         *ChapterP
+	ChapterC         *ChapterC
+	ChapterM         *ChapterM
+	ChapterW         *ChapterW
+	ChapterN         *ChapterN
+	ChapterE         *ChapterE
+	ChapterT         *ChapterT
+	ChapterA         *ChapterA
 }
 
 /*
@@ -28,7 +49,9 @@ const (
 	channelSFlag      = 0x8000 // Single Package Loss
 	channelMask       = 0x7800 // Channel Mask
 	channelHFlag      = 0x0400 // Use enhanced Chapter C encoding
-	channelLengthMask = 0x03f  //length mask
+	channelLengthMask = 0x03ff // length mask
+	channelShift      = 11
+	channelHeaderLen  = 3
 )
 
 // chapter Table of Content (TOC) (3rd octett)
@@ -43,7 +66,253 @@ const (
 	chapterA = 0x01 // Chapter A present
 )
 
-// Encode will write the channel journal to a package
-func (j *ChannelJournal) Encode() {
+// MIDI channel voice commands (status octet without channel)
+const (
+	noteOff           = 0x80
+	noteOn            = 0x90
+	polyAftertouch    = 0xa0
+	controlChange     = 0xb0
+	programChange     = 0xc0
+	channelAftertouch = 0xd0
+	pitchWheel        = 0xe0
+)
+
+// MIDI controller numbers
+const (
+	bankSelectMSB       = 0
+	bankSelectLSB       = 32
+	allSoundOff         = 120
+	resetAllControllers = 121
+	allNotesOff         = 123
+)
+
+// Encode will write the channel journals in ascending channel order.
+func (j *ChannelJournal) Encode(b *bytes.Buffer) error {
+	channels := make([]int, 0, len(j.Channels))
+	for channel := range j.Channels {
+		channels = append(channels, int(channel))
+	}
+	sort.Ints(channels)
+	for _, channel := range channels {
+		if err := j.Channels[uint8(channel)].encode(uint8(channel), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Chapters) encode(channel uint8, b *bytes.Buffer) error {
+	toc := byte(0)
+	chapters := new(bytes.Buffer)
+	if c.ChapterP != nil {
+		toc |= chapterP
+		c.ChapterP.encode(chapters)
+	}
+	if c.ChapterC != nil {
+		toc |= chapterC
+		c.ChapterC.encode(chapters)
+	}
+	if c.ChapterM != nil {
+		toc |= chapterM
+		if err := c.ChapterM.encode(chapters); err != nil {
+			return err
+		}
+	}
+	if c.ChapterW != nil {
+		toc |= chapterW
+		c.ChapterW.encode(chapters)
+	}
+	if c.ChapterN != nil {
+		toc |= chapterN
+		c.ChapterN.encode(chapters)
+	}
+	if c.ChapterE != nil {
+		toc |= chapterE
+		c.ChapterE.encode(chapters)
+	}
+	if c.ChapterT != nil {
+		toc |= chapterT
+		c.ChapterT.encode(chapters)
+	}
+	if c.ChapterA != nil {
+		toc |= chapterA
+		c.ChapterA.encode(chapters)
+	}
+
+	length := channelHeaderLen + chapters.Len()
+	if length > channelLengthMask {
+		return fmt.Errorf("channel journal of channel %d is too long: %d octets", channel, length)
+	}
+	header := uint16(channel)<<channelShift&channelMask | uint16(length)
+	if c.SinglePacketLoss {
+		header |= channelSFlag
+	}
+	if c.EnhancedChapterC {
+		header |= channelHFlag
+	}
+	binary.Write(b, binary.BigEndian, header)
+	b.WriteByte(toc)
+	b.Write(chapters.Bytes())
+	return nil
+}
+
+func decodeChannelJournal(buffer []byte, channels int) (j ChannelJournal, err error) {
+	j.Channels = map[uint8]Chapters{}
+	offset := 0
+	for i := 0; i < channels; i++ {
+		if len(buffer) < offset+channelHeaderLen {
+			return j, fmt.Errorf("%w: channel journal header", ErrTruncated)
+		}
+		header := binary.BigEndian.Uint16(buffer[offset:])
+		length := int(header & channelLengthMask)
+		if length < channelHeaderLen || len(buffer) < offset+length {
+			return j, fmt.Errorf("%w: channel journal of %d octets", ErrTruncated, length)
+		}
+		channel := uint8(header & channelMask >> channelShift)
+		c := Chapters{
+			SinglePacketLoss: header&channelSFlag != 0,
+			EnhancedChapterC: header&channelHFlag != 0,
+		}
+		if err = c.decode(buffer[offset+channelHeaderLen:offset+length], buffer[offset+2]); err != nil {
+			return
+		}
+		j.Channels[channel] = c
+		offset += length
+	}
+	return
+}
+
+// decode the chapters listed in the table of content.
+func (c *Chapters) decode(buffer []byte, toc byte) error {
+	offset := 0
+	if toc&chapterP != 0 {
+		chapter, n, err := decodeChapterP(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterP = &chapter
+		offset += n
+	}
+	if toc&chapterC != 0 {
+		chapter, n, err := decodeChapterC(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterC = &chapter
+		offset += n
+	}
+	if toc&chapterM != 0 {
+		chapter, n, err := decodeChapterM(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterM = &chapter
+		offset += n
+	}
+	if toc&chapterW != 0 {
+		chapter, n, err := decodeChapterW(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterW = &chapter
+		offset += n
+	}
+	if toc&chapterN != 0 {
+		chapter, n, err := decodeChapterN(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterN = &chapter
+		offset += n
+	}
+	if toc&chapterE != 0 {
+		chapter, n, err := decodeChapterE(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterE = &chapter
+		offset += n
+	}
+	if toc&chapterT != 0 {
+		chapter, n, err := decodeChapterT(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterT = &chapter
+		offset += n
+	}
+	if toc&chapterA != 0 {
+		chapter, n, err := decodeChapterA(buffer[offset:])
+		if err != nil {
+			return err
+		}
+		c.ChapterA = &chapter
+		offset += n
+	}
+	return nil
+}
+
+// channelState tracks the commands sent on a single MIDI channel.
+type channelState struct {
+	program         programState
+	controllers     controllerState
+	parameters      parameterState
+	pitchWheel      pitchWheelState
+	notes           noteState
+	noteExtras      noteExtraState
+	channelPressure channelPressureState
+	pressure        pressureState
+}
+
+func (c *channelState) record(seqNum uint32, t time.Time, p rtp.MIDIPayload) {
+	c.program.record(seqNum, p)
+	c.controllers.record(seqNum, p)
+	c.parameters.record(seqNum, p)
+	c.pitchWheel.record(seqNum, p)
+	c.notes.record(seqNum, t, p)
+	c.noteExtras.record(seqNum, p)
+	c.channelPressure.record(seqNum, p)
+	c.pressure.record(seqNum, p)
+}
 
+// chapters returns the chapters for the commands sent since the checkpoint.
+func (c *channelState) chapters(checkpoint, seqNum uint32, now time.Time, enhanced bool) (chapters Chapters, found bool) {
+	chapters.SinglePacketLoss = true
+	if chapters.ChapterP = c.program.chapter(checkpoint, seqNum); chapters.ChapterP != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterP.S
+	}
+	if chapters.ChapterC = c.controllers.chapter(checkpoint, seqNum, enhanced); chapters.ChapterC != nil {
+		found = true
+		chapters.EnhancedChapterC = enhanced
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterC.S
+	}
+	if chapters.ChapterM = c.parameters.chapter(checkpoint, seqNum); chapters.ChapterM != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterM.S
+	}
+	if chapters.ChapterW = c.pitchWheel.chapter(checkpoint, seqNum); chapters.ChapterW != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterW.S
+	}
+	if chapters.ChapterN = c.notes.chapter(checkpoint, seqNum, now); chapters.ChapterN != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterN.B
+		for _, on := range chapters.ChapterN.NoteOn {
+			chapters.SinglePacketLoss = chapters.SinglePacketLoss && on.S
+		}
+	}
+	if chapters.ChapterE = c.noteExtras.chapter(checkpoint, seqNum); chapters.ChapterE != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterE.S
+	}
+	if chapters.ChapterT = c.channelPressure.chapter(checkpoint, seqNum); chapters.ChapterT != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterT.S
+	}
+	if chapters.ChapterA = c.pressure.chapter(checkpoint, seqNum); chapters.ChapterA != nil {
+		found = true
+		chapters.SinglePacketLoss = chapters.SinglePacketLoss && chapters.ChapterA.S
+	}
+	return
 }
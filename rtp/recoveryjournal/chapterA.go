@@ -0,0 +1,114 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|    LEN      |S|   NOTENUM   |X|  PRESSURE   |S|   NOTENUM   |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |X|  PRESSURE   |  ....                                         |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                Figure A.9.1 -- Chapter A format
+
+*/
+
+const (
+	chapterASFlag   = 0x80
+	chapterALenMask = 0x7f
+	pressureXFlag   = 0x80 // the note was turned off after the aftertouch
+)
+
+// ChapterA is responsible for MIDI Poly Aftertouch (0xA) commands
+type ChapterA struct {
+	S    bool
+	Logs []PressureLog // Max. 128 pressure logs
+}
+
+// PressureLog contains the last Poly Aftertouch of a note.
+type PressureLog struct {
+	S        bool
+	NoteNum  uint8
+	X        bool // true if the note was turned off after the aftertouch
+	Pressure uint8
+}
+
+func (c ChapterA) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterASFlag) | byte(len(c.Logs)-1)&chapterALenMask)
+	for _, l := range c.Logs {
+		b.WriteByte(flag(l.S, chapterASFlag) | l.NoteNum&noteLogValueMask)
+		b.WriteByte(flag(l.X, pressureXFlag) | l.Pressure&noteLogValueMask)
+	}
+}
+
+func decodeChapterA(buffer []byte) (c ChapterA, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter A header", ErrTruncated)
+	}
+	c.S = buffer[0]&chapterASFlag != 0
+	logs := int(buffer[0]&chapterALenMask) + 1
+	n = 1
+	if len(buffer) < n+2*logs {
+		return c, n, fmt.Errorf("%w: chapter A pressure logs", ErrTruncated)
+	}
+	for i := 0; i < logs; i++ {
+		c.Logs = append(c.Logs, PressureLog{
+			S:        buffer[n]&chapterASFlag != 0,
+			NoteNum:  buffer[n] & noteLogValueMask,
+			X:        buffer[n+1]&pressureXFlag != 0,
+			Pressure: buffer[n+1] & noteLogValueMask,
+		})
+		n += 2
+	}
+	return
+}
+
+// pressureState tracks the Poly Aftertouch commands of a channel
+type pressureState struct {
+	notes [128]pressureLog
+}
+
+type pressureLog struct {
+	recorded bool
+	seqNum   uint32
+	pressure uint8
+	off      bool
+}
+
+func (a *pressureState) record(seqNum uint32, p rtp.MIDIPayload) {
+	switch p[0] & 0xf0 {
+	case polyAftertouch:
+		a.notes[p[1]&0x7f] = pressureLog{recorded: true, seqNum: seqNum, pressure: p[2] & 0x7f}
+	case noteOff, noteOn:
+		l := &a.notes[p[1]&0x7f]
+		if l.recorded && (p[0]&0xf0 == noteOff || p[2] == 0) {
+			l.off = true
+			l.seqNum = seqNum
+		}
+	}
+}
+
+// chapter returns the Chapter A for the notes with aftertouch since the checkpoint.
+func (a *pressureState) chapter(checkpoint, seqNum uint32) *ChapterA {
+	chapter := ChapterA{S: true}
+	for note, l := range a.notes {
+		if !l.recorded || seqNumBefore(l.seqNum, checkpoint) {
+			continue
+		}
+		s := l.seqNum != seqNum-1
+		chapter.S = chapter.S && s
+		chapter.Logs = append(chapter.Logs, PressureLog{S: s, NoteNum: uint8(note), X: l.off, Pressure: l.pressure})
+	}
+	if len(chapter.Logs) == 0 {
+		return nil
+	}
+	return &chapter
+}
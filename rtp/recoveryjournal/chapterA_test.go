@@ -0,0 +1,59 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterA(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterA{Logs: []PressureLog{
+		{S: true, NoteNum: 0x3c, Pressure: 0x20},
+		{NoteNum: 0x40, X: true, Pressure: 0x10},
+	}}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterA(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x01, 0xbc, 0x20, 0x40, 0x90}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_pressureState_marks_released_notes(t *testing.T) {
+	// given
+	a := pressureState{}
+	a.record(1, []byte{0xa0, 0x3c, 0x20})
+	a.record(1, []byte{0xa0, 0x40, 0x10})
+	a.record(2, []byte{0x90, 0x40, 0x00})
+	// when
+	c := a.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterA{Logs: []PressureLog{
+		{S: true, NoteNum: 0x3c, Pressure: 0x20},
+		{NoteNum: 0x40, X: true, Pressure: 0x10},
+	}}, c)
+}
+
+func Test_receiver_restores_pressure_of_playing_notes(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0x90, 0x3c, 0x40}, []byte{0x90, 0x3e, 0x40}), s))
+	withJournal(message(2, now, []byte{0xa0, 0x3c, 0x20}, []byte{0xa0, 0x3e, 0x20}, []byte{0x80, 0x3e, 0x00}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now.Add(time.Second)), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0x80, 0x3e, 0x00}},
+		{Payload: []byte{0xa0, 0x3c, 0x20}},
+	}, repair)
+}
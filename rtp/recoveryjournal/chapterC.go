@@ -0,0 +1,209 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|     LEN     |S|   NUMBER    |A|  VALUE/ALT  |S|   NUMBER    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |A|  VALUE/ALT  |  ....                                         |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                Figure A.3.1 -- Chapter C format
+
+   With A = 1, the ALT field is split into the T bit and a 6 bit
+   TOGGLE (T = 0) or COUNT (T = 1) field.
+
+*/
+
+const (
+	chapterCSFlag   = 0x80
+	chapterCLenMask = 0x7f
+	controllerAFlag = 0x80 // ALT field present
+	controllerTFlag = 0x40 // COUNT instead of TOGGLE
+	controllerAlt   = 0x3f
+)
+
+// ControllerTool defines how the VALUE/ALT field of a controller log is coded.
+type ControllerTool uint8
+
+const (
+	// ValueTool codes the last value of the controller.
+	ValueTool ControllerTool = iota
+	// ToggleTool codes the number of on/off toggles of a switch controller (mod 64).
+	ToggleTool
+	// CountTool codes the number of commands of the controller (mod 64).
+	CountTool
+)
+
+// ChapterC is responsible for MIDI Control Change (0xB) commands
+type ChapterC struct {
+	S    bool
+	Logs []ControllerLog // Max. 128 controller logs
+}
+
+// ControllerLog contains the state of a single controller.
+type ControllerLog struct {
+	S      bool
+	Number uint8
+	Tool   ControllerTool
+	Value  uint8 // VALUE, TOGGLE or COUNT depending on the Tool
+}
+
+func (c ChapterC) encode(b *bytes.Buffer) {
+	header := byte(len(c.Logs)-1) & chapterCLenMask
+	if c.S {
+		header |= chapterCSFlag
+	}
+	b.WriteByte(header)
+	for _, l := range c.Logs {
+		number := l.Number & noteLogValueMask
+		if l.S {
+			number |= chapterCSFlag
+		}
+		var value byte
+		switch l.Tool {
+		case ValueTool:
+			value = l.Value & noteLogValueMask
+		case ToggleTool:
+			value = controllerAFlag | l.Value&controllerAlt
+		case CountTool:
+			value = controllerAFlag | controllerTFlag | l.Value&controllerAlt
+		}
+		b.WriteByte(number)
+		b.WriteByte(value)
+	}
+}
+
+func decodeChapterC(buffer []byte) (c ChapterC, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter C header", ErrTruncated)
+	}
+	c.S = buffer[0]&chapterCSFlag != 0
+	logs := int(buffer[0]&chapterCLenMask) + 1
+	n = 1
+	if len(buffer) < n+2*logs {
+		return c, n, fmt.Errorf("%w: chapter C controller logs", ErrTruncated)
+	}
+	for i := 0; i < logs; i++ {
+		l := ControllerLog{
+			S:      buffer[n]&chapterCSFlag != 0,
+			Number: buffer[n] & noteLogValueMask,
+		}
+		value := buffer[n+1]
+		switch {
+		case value&controllerAFlag == 0:
+			l.Tool, l.Value = ValueTool, value
+		case value&controllerTFlag == 0:
+			l.Tool, l.Value = ToggleTool, value&controllerAlt
+		default:
+			l.Tool, l.Value = CountTool, value&controllerAlt
+		}
+		c.Logs = append(c.Logs, l)
+		n += 2
+	}
+	return
+}
+
+// switchController returns true for the controllers which are either on or off
+// (sustain, portamento, sostenuto, soft pedal, legato, hold 2).
+func switchController(number uint8) bool {
+	return number >= 64 && number <= 69
+}
+
+// modeController returns true for the channel mode messages.
+func modeController(number uint8) bool {
+	return number >= allSoundOff
+}
+
+// controllerState tracks the Control Change commands of a channel except the
+// parameter system controllers which are coded in Chapter M.
+type controllerState struct {
+	controllers [128]controllerLog
+}
+
+type controllerLog struct {
+	recorded bool
+	seqNum   uint32 // extended sequence number of the most recent command
+	value    uint8
+	toggles  uint8 // number of on/off toggles since the start of the stream
+	count    uint8 // number of commands since the start of the stream
+}
+
+func (c *controllerState) record(seqNum uint32, p rtp.MIDIPayload) {
+	if p[0]&0xf0 != controlChange || parameterController(p[1]) {
+		return
+	}
+	l := &c.controllers[p[1]&0x7f]
+	value := p[2] & 0x7f
+	// before the first command the switch is off
+	if switchOn(l.value) != switchOn(value) {
+		l.toggles++
+	}
+	l.recorded = true
+	l.seqNum = seqNum
+	l.value = value
+	l.count++
+}
+
+// chapter returns the Chapter C for the controllers changed since the checkpoint
+// or nil if no controller was changed since.
+//
+// Every controller is coded with the value tool. With the enhanced encoding, switch
+// controllers are additionally coded with the toggle tool and channel mode messages
+// with the count tool. If the logs exceed the maximum of 128, the toggle and count
+// logs of the least recently changed controllers are left out, the value logs are
+// always coded.
+func (c *controllerState) chapter(checkpoint, seqNum uint32, enhanced bool) *ChapterC {
+	chapter := ChapterC{S: true}
+	type altLog struct {
+		log    ControllerLog
+		seqNum uint32
+	}
+	var alternatives []altLog
+	for number, l := range c.controllers {
+		if !l.recorded || seqNumBefore(l.seqNum, checkpoint) {
+			continue
+		}
+		s := l.seqNum != seqNum-1
+		chapter.S = chapter.S && s
+		n := uint8(number)
+		chapter.Logs = append(chapter.Logs, ControllerLog{S: s, Number: n, Tool: ValueTool, Value: l.value})
+		if enhanced && switchController(n) {
+			alternatives = append(alternatives, altLog{ControllerLog{S: s, Number: n, Tool: ToggleTool, Value: l.toggles & controllerAlt}, l.seqNum})
+		}
+		if enhanced && modeController(n) {
+			alternatives = append(alternatives, altLog{ControllerLog{S: s, Number: n, Tool: CountTool, Value: l.count & controllerAlt}, l.seqNum})
+		}
+	}
+	if len(chapter.Logs) == 0 {
+		return nil
+	}
+	if free := chapterCLenMask + 1 - len(chapter.Logs); len(alternatives) > free {
+		sort.SliceStable(alternatives, func(i, j int) bool {
+			return seqNumBefore(alternatives[j].seqNum, alternatives[i].seqNum)
+		})
+		alternatives = alternatives[:free]
+	}
+	for _, a := range alternatives {
+		chapter.Logs = append(chapter.Logs, a.log)
+	}
+	sort.SliceStable(chapter.Logs, func(i, j int) bool {
+		return chapter.Logs[i].Number < chapter.Logs[j].Number
+	})
+	return &chapter
+}
+
+// switchOn returns true if the value of a switch controller means on.
+func switchOn(value uint8) bool {
+	return value >= 64
+}
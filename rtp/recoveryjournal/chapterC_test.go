@@ -0,0 +1,157 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_encode_of_chapterC(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterC{
+		S: true,
+		Logs: []ControllerLog{
+			{S: true, Number: 0x01, Tool: ValueTool, Value: 0x40},
+			{S: true, Number: 0x40, Tool: ToggleTool, Value: 0x03},
+			{S: true, Number: 0x79, Tool: CountTool, Value: 0x02},
+		},
+	}
+	// when
+	c.encode(b)
+	// then
+	assert.Equal(t, []byte{
+		0x82,       // Header (S, LEN=2)
+		0x81, 0x40, // Modulation value
+		0xc0, 0x83, // Sustain toggle
+		0xf9, 0xc2, // Reset all controllers count
+	}, b.Bytes())
+	actual, n, err := decodeChapterC(b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, b.Len(), n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_controllerState_tracks_last_value(t *testing.T) {
+	// given
+	c := controllerState{}
+	c.record(1, []byte{0xb0, 0x01, 0x10})
+	c.record(2, []byte{0xb0, 0x01, 0x20})
+	c.record(2, []byte{0xb0, 0x07, 0x64})
+	// when
+	chapter := c.chapter(1, 4, false)
+	// then
+	assert.Equal(t, &ChapterC{S: true, Logs: []ControllerLog{
+		{S: true, Number: 0x01, Value: 0x20},
+		{S: true, Number: 0x07, Value: 0x64},
+	}}, chapter)
+}
+
+func Test_enhanced_encoding_counts_toggles(t *testing.T) {
+	// given
+	c := controllerState{}
+	c.record(1, []byte{0xb0, 0x40, 0x7f})
+	c.record(2, []byte{0xb0, 0x40, 0x00})
+	c.record(3, []byte{0xb0, 0x40, 0x7f})
+	c.record(3, []byte{0xb0, 0x40, 0x7e})
+	// when
+	chapter := c.chapter(1, 4, true)
+	// then
+	assert.Equal(t, &ChapterC{S: false, Logs: []ControllerLog{
+		{S: false, Number: 0x40, Tool: ValueTool, Value: 0x7e},
+		{S: false, Number: 0x40, Tool: ToggleTool, Value: 3},
+	}}, chapter)
+}
+
+func Test_first_off_value_is_not_a_toggle(t *testing.T) {
+	// given
+	c := controllerState{}
+	c.record(1, []byte{0xb0, 0x40, 0x00})
+	c.record(2, []byte{0xb0, 0x40, 0x10})
+	// when
+	chapter := c.chapter(1, 3, true)
+	// then
+	assert.Equal(t, []ControllerLog{
+		{Number: 0x40, Tool: ValueTool, Value: 0x10},
+		{Number: 0x40, Tool: ToggleTool, Value: 0},
+	}, chapter.Logs)
+}
+
+func Test_oldest_toggle_logs_are_left_out(t *testing.T) {
+	// given
+	c := controllerState{}
+	seqNum := uint32(1)
+	for number := byte(0); number < 0x80; number++ {
+		if !parameterController(number) {
+			c.record(seqNum, []byte{0xb0, number, 0x7f})
+			seqNum++
+		}
+	}
+	// when
+	chapter := c.chapter(1, seqNum, true)
+	// then
+	assert.Len(t, chapter.Logs, 128)
+	values, alternatives := 0, map[uint8]bool{}
+	for _, l := range chapter.Logs {
+		if l.Tool == ValueTool {
+			values++
+		} else {
+			alternatives[l.Number] = true
+		}
+	}
+	assert.Equal(t, 120, values)
+	assert.False(t, alternatives[0x40])
+	assert.True(t, alternatives[0x7f])
+}
+
+func Test_receiver_replays_lost_toggles(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.EnhancedChapterC = true
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xb0, 0x40, 0x7f}), s))
+	withJournal(message(2, now, []byte{0xb0, 0x40, 0x00}), s) // lost
+	withJournal(message(3, now, []byte{0xb0, 0x40, 0x7f}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(4, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xb0, 0x40, 0x00}},
+		{Payload: []byte{0xb0, 0x40, 0x7f}},
+	}, repair)
+}
+
+func Test_receiver_restores_first_off_value(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.EnhancedChapterC = true
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xb0, 0x01, 0x10}), s))
+	withJournal(message(2, now, []byte{0xb0, 0x40, 0x00}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0xb0, 0x40, 0x00}}}, repair)
+}
+
+func Test_receiver_restores_controllers(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.EnhancedChapterC = true
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xb0, 0x40, 0x7f}, []byte{0xb0, 0x01, 0x10}), s))
+	withJournal(message(2, now, []byte{0xb0, 0x40, 0x00}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0xb0, 0x40, 0x00}}}, repair)
+}
@@ -0,0 +1,325 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0 1 2 3 4 5 6 7
+   +-+-+-+-+-+-+-+-+
+   |S|B|G|H|J|K|Y|Z|  Command logs ...
+   +-+-+-+-+-+-+-+-+
+
+    Figure B.1.1 -- Chapter D format
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|C|V|L|DSZ|       LENGTH      |     COUNT     |  VALUE ...    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+    Figure B.1.2 -- System Common log format (J and K)
+
+    0                   1
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|C|L|  LENGTH |     COUNT     |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+    Figure B.1.3 -- System Real-time log format (Y and Z)
+
+   The B (Reset), G (Tune Request) and H (Song Select) logs are a single
+   octet with the S flag followed by a 7 bit COUNT or VALUE.
+
+*/
+
+const (
+	chapterDSFlag = 0x80
+	chapterDBFlag = 0x40 // Reset log present
+	chapterDGFlag = 0x20 // Tune Request log present
+	chapterDHFlag = 0x10 // Song Select log present
+	chapterDJFlag = 0x08 // undefined System Common 0xF4 log present
+	chapterDKFlag = 0x04 // undefined System Common 0xF5 log present
+	chapterDYFlag = 0x02 // undefined System Real-time 0xF9 log present
+	chapterDZFlag = 0x01 // undefined System Real-time 0xFD log present
+
+	commonLogSFlag      = 0x8000
+	commonLogCFlag      = 0x4000 // COUNT present
+	commonLogVFlag      = 0x2000 // VALUE present
+	commonLogLFlag      = 0x1000 // LEGAL present
+	commonLogDSZShift   = 10
+	commonLogLengthMask = 0x03ff
+
+	realTimeLogSFlag      = 0x80
+	realTimeLogCFlag      = 0x40 // COUNT present
+	realTimeLogLFlag      = 0x20 // LEGAL present
+	realTimeLogLengthMask = 0x1f
+)
+
+// ChapterD is responsible for the MIDI Reset, Tune Request, Song Select and
+// the undefined System Common and System Real-time commands.
+type ChapterD struct {
+	S           bool
+	Reset       *SystemLog   // Number of Reset (0xFF) commands (modulo 128)
+	TuneRequest *SystemLog   // Number of Tune Request (0xF6) commands (modulo 128)
+	SongSelect  *SystemLog   // Value of the last Song Select (0xF3) command
+	UndefinedF4 *CommonLog   // undefined System Common 0xF4
+	UndefinedF5 *CommonLog   // undefined System Common 0xF5
+	UndefinedF9 *RealTimeLog // undefined System Real-time 0xF9
+	UndefinedFD *RealTimeLog // undefined System Real-time 0xFD
+}
+
+// SystemLog contains a single 7 bit count or value.
+type SystemLog struct {
+	S     bool
+	Value uint8
+}
+
+// CommonLog contains the number of commands (modulo 256) and the data octets of the
+// last undefined System Common command.
+type CommonLog struct {
+	S     bool
+	Count uint8
+	Data  []byte
+}
+
+// RealTimeLog contains the number of commands (modulo 256) of an undefined System
+// Real-time command.
+type RealTimeLog struct {
+	S     bool
+	Count uint8
+}
+
+func (c ChapterD) encode(b *bytes.Buffer) {
+	header := flag(c.S, chapterDSFlag) |
+		flag(c.Reset != nil, chapterDBFlag) |
+		flag(c.TuneRequest != nil, chapterDGFlag) |
+		flag(c.SongSelect != nil, chapterDHFlag) |
+		flag(c.UndefinedF4 != nil, chapterDJFlag) |
+		flag(c.UndefinedF5 != nil, chapterDKFlag) |
+		flag(c.UndefinedF9 != nil, chapterDYFlag) |
+		flag(c.UndefinedFD != nil, chapterDZFlag)
+	b.WriteByte(header)
+	for _, l := range []*SystemLog{c.Reset, c.TuneRequest, c.SongSelect} {
+		if l != nil {
+			b.WriteByte(flag(l.S, chapterDSFlag) | l.Value&systemDataMask)
+		}
+	}
+	for _, l := range []*CommonLog{c.UndefinedF4, c.UndefinedF5} {
+		if l != nil {
+			l.encode(b)
+		}
+	}
+	for _, l := range []*RealTimeLog{c.UndefinedF9, c.UndefinedFD} {
+		if l != nil {
+			b.WriteByte(flag(l.S, realTimeLogSFlag) | realTimeLogCFlag | 2)
+			b.WriteByte(l.Count)
+		}
+	}
+}
+
+func (l CommonLog) encode(b *bytes.Buffer) {
+	size := len(l.Data)
+	if size > 3 {
+		size = 3
+	}
+	header := uint16(commonLogCFlag) | uint16(size)<<commonLogDSZShift | uint16(3+len(l.Data))
+	if l.S {
+		header |= commonLogSFlag
+	}
+	if len(l.Data) > 0 {
+		header |= commonLogVFlag
+	}
+	binary.Write(b, binary.BigEndian, header)
+	b.WriteByte(l.Count)
+	for i, d := range l.Data {
+		b.WriteByte(flag(i == len(l.Data)-1, systemLogMSBFlag) | d&systemDataMask)
+	}
+}
+
+func decodeChapterD(buffer []byte) (c ChapterD, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter D header", ErrTruncated)
+	}
+	header := buffer[0]
+	c.S = header&chapterDSFlag != 0
+	n = 1
+	for _, l := range []struct {
+		mask byte
+		log  **SystemLog
+	}{{chapterDBFlag, &c.Reset}, {chapterDGFlag, &c.TuneRequest}, {chapterDHFlag, &c.SongSelect}} {
+		if header&l.mask == 0 {
+			continue
+		}
+		if len(buffer) < n+1 {
+			return c, n, fmt.Errorf("%w: chapter D log", ErrTruncated)
+		}
+		*l.log = &SystemLog{S: buffer[n]&chapterDSFlag != 0, Value: buffer[n] & systemDataMask}
+		n++
+	}
+	for _, l := range []struct {
+		mask byte
+		log  **CommonLog
+	}{{chapterDJFlag, &c.UndefinedF4}, {chapterDKFlag, &c.UndefinedF5}} {
+		if header&l.mask == 0 {
+			continue
+		}
+		log, size, err := decodeCommonLog(buffer[n:])
+		if err != nil {
+			return c, n, err
+		}
+		*l.log = &log
+		n += size
+	}
+	for _, l := range []struct {
+		mask byte
+		log  **RealTimeLog
+	}{{chapterDYFlag, &c.UndefinedF9}, {chapterDZFlag, &c.UndefinedFD}} {
+		if header&l.mask == 0 {
+			continue
+		}
+		if len(buffer) < n+1 {
+			return c, n, fmt.Errorf("%w: chapter D real-time log", ErrTruncated)
+		}
+		length := int(buffer[n] & realTimeLogLengthMask)
+		if length < 1 || len(buffer) < n+length {
+			return c, n, fmt.Errorf("%w: chapter D real-time log of %d octets", ErrTruncated, length)
+		}
+		log := RealTimeLog{S: buffer[n]&realTimeLogSFlag != 0}
+		if buffer[n]&realTimeLogCFlag != 0 && length > 1 {
+			log.Count = buffer[n+1]
+		}
+		*l.log = &log
+		n += length
+	}
+	return
+}
+
+func decodeCommonLog(buffer []byte) (l CommonLog, n int, err error) {
+	if len(buffer) < 2 {
+		return l, 0, fmt.Errorf("%w: chapter D common log header", ErrTruncated)
+	}
+	header := binary.BigEndian.Uint16(buffer)
+	length := int(header & commonLogLengthMask)
+	if length < 2 || len(buffer) < length {
+		return l, 0, fmt.Errorf("%w: chapter D common log of %d octets", ErrTruncated, length)
+	}
+	l.S = header&commonLogSFlag != 0
+	n = 2
+	if header&commonLogCFlag != 0 && n < length {
+		l.Count = buffer[n]
+		n++
+	}
+	if header&commonLogVFlag != 0 {
+		for ; n < length; n++ {
+			l.Data = append(l.Data, buffer[n]&systemDataMask)
+			if buffer[n]&systemLogMSBFlag != 0 {
+				break
+			}
+		}
+	}
+	return l, length, nil
+}
+
+// commandState tracks the commands of Chapter D.
+type commandState struct {
+	reset       commandLog
+	tuneRequest commandLog
+	songSelect  commandLog
+	undefinedF4 commandLog
+	undefinedF5 commandLog
+	undefinedF9 commandLog
+	undefinedFD commandLog
+}
+
+type commandLog struct {
+	recorded bool
+	seqNum   uint32
+	count    uint8
+	value    uint8
+	data     []byte
+}
+
+func (l *commandLog) update(seqNum uint32) {
+	l.recorded = true
+	l.seqNum = seqNum
+	l.count++
+}
+
+func (c *commandState) record(seqNum uint32, p rtp.MIDIPayload) {
+	switch p[0] {
+	case systemReset:
+		c.reset.update(seqNum)
+	case tuneRequest:
+		c.tuneRequest.update(seqNum)
+	case songSelect:
+		if len(p) > 1 {
+			c.songSelect.update(seqNum)
+			c.songSelect.value = p[1] & systemDataMask
+		}
+	case undefinedF4:
+		c.undefinedF4.update(seqNum)
+		c.undefinedF4.data = commandData(p)
+	case undefinedF5:
+		c.undefinedF5.update(seqNum)
+		c.undefinedF5.data = commandData(p)
+	case undefinedF9:
+		c.undefinedF9.update(seqNum)
+	case undefinedFD:
+		c.undefinedFD.update(seqNum)
+	}
+}
+
+// commandData returns a copy of the data octets of a System Common command.
+func commandData(p rtp.MIDIPayload) []byte {
+	if len(p) < 2 {
+		return nil
+	}
+	return append([]byte{}, p[1:]...)
+}
+
+// chapter returns the Chapter D for the commands sent since the checkpoint
+// or nil if none of its commands was sent since.
+func (c *commandState) chapter(checkpoint, seqNum uint32) *ChapterD {
+	chapter := ChapterD{S: true}
+	found := false
+	changed := func(l commandLog) (bool, bool) {
+		if !l.recorded || seqNumBefore(l.seqNum, checkpoint) {
+			return false, false
+		}
+		s := l.seqNum != seqNum-1
+		found = true
+		chapter.S = chapter.S && s
+		return true, s
+	}
+	if ok, s := changed(c.reset); ok {
+		chapter.Reset = &SystemLog{S: s, Value: c.reset.count & systemDataMask}
+	}
+	if ok, s := changed(c.tuneRequest); ok {
+		chapter.TuneRequest = &SystemLog{S: s, Value: c.tuneRequest.count & systemDataMask}
+	}
+	if ok, s := changed(c.songSelect); ok {
+		chapter.SongSelect = &SystemLog{S: s, Value: c.songSelect.value}
+	}
+	if ok, s := changed(c.undefinedF4); ok {
+		chapter.UndefinedF4 = &CommonLog{S: s, Count: c.undefinedF4.count, Data: c.undefinedF4.data}
+	}
+	if ok, s := changed(c.undefinedF5); ok {
+		chapter.UndefinedF5 = &CommonLog{S: s, Count: c.undefinedF5.count, Data: c.undefinedF5.data}
+	}
+	if ok, s := changed(c.undefinedF9); ok {
+		chapter.UndefinedF9 = &RealTimeLog{S: s, Count: c.undefinedF9.count}
+	}
+	if ok, s := changed(c.undefinedFD); ok {
+		chapter.UndefinedFD = &RealTimeLog{S: s, Count: c.undefinedFD.count}
+	}
+	if !found {
+		return nil
+	}
+	return &chapter
+}
@@ -0,0 +1,71 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterD(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterD{
+		S:           true,
+		Reset:       &SystemLog{S: true, Value: 0x02},
+		SongSelect:  &SystemLog{Value: 0x05},
+		UndefinedF4: &CommonLog{Count: 0x01, Data: []byte{0x10, 0x20}},
+		UndefinedFD: &RealTimeLog{S: true, Count: 0x03},
+	}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterD(b.Bytes())
+	// then
+	assert.Equal(t, []byte{
+		0xd9,       // Header (S, B, H, J, Z)
+		0x82,       // Reset
+		0x05,       // Song Select
+		0x68, 0x05, // F4 log header (C, V, DSZ=2, LENGTH=5)
+		0x01, 0x10, 0xa0, // COUNT, VALUE
+		0xc2, 0x03, // FD log
+	}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, b.Len(), n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_commandState_counts_commands(t *testing.T) {
+	// given
+	c := commandState{}
+	c.record(1, []byte{0xff})
+	c.record(1, []byte{0xf3, 0x02})
+	c.record(2, []byte{0xff})
+	c.record(2, []byte{0xf9})
+	// when
+	d := c.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterD{
+		Reset:       &SystemLog{Value: 0x02},
+		SongSelect:  &SystemLog{S: true, Value: 0x02},
+		UndefinedF9: &RealTimeLog{Count: 0x01},
+	}, d)
+}
+
+func Test_receiver_restores_song_select(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xf3, 0x01}), s))
+	withJournal(message(2, now, []byte{0xf3, 0x04}, []byte{0xf6}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xf6}},
+		{Payload: []byte{0xf3, 0x04}},
+	}, repair)
+}
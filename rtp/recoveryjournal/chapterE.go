@@ -0,0 +1,147 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|     LEN     |S|   NOTENUM   |V|  COUNT/VEL  |S|   NOTENUM   |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |V|  COUNT/VEL  |             ....                              |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                Figure A.7.1 -- Chapter E format
+
+*/
+
+const (
+	chapterESFlag   = 0x80
+	chapterELenMask = 0x7f
+	noteExtraVFlag  = 0x80 // the log codes the note-off velocity
+)
+
+// ChapterE is responsible for the extra information of MIDI NoteOn (0x9)
+// and NoteOff (0x8) commands which is not covered by Chapter N.
+type ChapterE struct {
+	S    bool
+	Logs []NoteExtra // Max. 128 note extra logs
+}
+
+// NoteExtra contains either the note-off velocity or the reference count of a note.
+type NoteExtra struct {
+	S       bool
+	NoteNum uint8
+	// V is true if Value is the velocity of the last NoteOff, otherwise Value
+	// is the number of NoteOn commands without a matching NoteOff.
+	V     bool
+	Value uint8
+}
+
+func (c ChapterE) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterESFlag) | byte(len(c.Logs)-1)&chapterELenMask)
+	for _, l := range c.Logs {
+		b.WriteByte(flag(l.S, chapterESFlag) | l.NoteNum&noteLogValueMask)
+		b.WriteByte(flag(l.V, noteExtraVFlag) | l.Value&noteLogValueMask)
+	}
+}
+
+func decodeChapterE(buffer []byte) (c ChapterE, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter E header", ErrTruncated)
+	}
+	c.S = buffer[0]&chapterESFlag != 0
+	logs := int(buffer[0]&chapterELenMask) + 1
+	n = 1
+	if len(buffer) < n+2*logs {
+		return c, n, fmt.Errorf("%w: chapter E note logs", ErrTruncated)
+	}
+	for i := 0; i < logs; i++ {
+		c.Logs = append(c.Logs, NoteExtra{
+			S:       buffer[n]&chapterESFlag != 0,
+			NoteNum: buffer[n] & noteLogValueMask,
+			V:       buffer[n+1]&noteExtraVFlag != 0,
+			Value:   buffer[n+1] & noteLogValueMask,
+		})
+		n += 2
+	}
+	return
+}
+
+// noteExtraState tracks the NoteOff velocities and the overlapping NoteOn commands of a channel
+type noteExtraState struct {
+	notes [128]noteExtraLog
+}
+
+type noteExtraLog struct {
+	recorded    bool
+	seqNum      uint32
+	count       uint8 // NoteOn commands without a matching NoteOff
+	off         bool
+	offVelocity uint8
+}
+
+func (e *noteExtraState) record(seqNum uint32, p rtp.MIDIPayload) {
+	switch p[0] & 0xf0 {
+	case noteOn:
+		if p[2] > 0 {
+			l := &e.notes[p[1]&0x7f]
+			l.recorded, l.seqNum, l.off = true, seqNum, false
+			if l.count < noteLogValueMask {
+				l.count++
+			}
+			return
+		}
+		e.noteOff(seqNum, p[1], 0)
+	case noteOff:
+		e.noteOff(seqNum, p[1], p[2]&0x7f)
+	case controlChange:
+		if p[1] == allSoundOff || p[1] >= allNotesOff {
+			for note, l := range e.notes {
+				if l.recorded && l.count > 0 {
+					e.notes[note] = noteExtraLog{recorded: true, seqNum: seqNum, off: true}
+				}
+			}
+		}
+	}
+}
+
+func (e *noteExtraState) noteOff(seqNum uint32, note, velocity uint8) {
+	l := &e.notes[note&0x7f]
+	l.recorded, l.seqNum, l.off, l.offVelocity = true, seqNum, true, velocity
+	if l.count > 0 {
+		l.count--
+	}
+}
+
+// chapter returns the Chapter E for the notes with a NoteOff velocity or with
+// overlapping NoteOn commands since the checkpoint.
+func (e *noteExtraState) chapter(checkpoint, seqNum uint32) *ChapterE {
+	chapter := ChapterE{S: true}
+	for note, l := range e.notes {
+		if !l.recorded || seqNumBefore(l.seqNum, checkpoint) {
+			continue
+		}
+		log := NoteExtra{S: l.seqNum != seqNum-1, NoteNum: uint8(note)}
+		switch {
+		case l.off && l.count == 0 && l.offVelocity > 0:
+			log.V, log.Value = true, l.offVelocity
+		case (l.off && l.count > 0) || l.count > 1:
+			log.Value = l.count
+		default:
+			continue
+		}
+		chapter.S = chapter.S && log.S
+		chapter.Logs = append(chapter.Logs, log)
+	}
+	if len(chapter.Logs) == 0 {
+		return nil
+	}
+	return &chapter
+}
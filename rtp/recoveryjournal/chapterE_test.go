@@ -0,0 +1,60 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterE(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterE{Logs: []NoteExtra{
+		{S: true, NoteNum: 0x3c, V: true, Value: 0x20},
+		{NoteNum: 0x40, Value: 0x02},
+	}}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterE(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x01, 0xbc, 0xa0, 0x40, 0x02}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_noteExtraState_tracks_velocity_and_count(t *testing.T) {
+	// given
+	e := noteExtraState{}
+	e.record(1, []byte{0x90, 0x3c, 0x40})
+	e.record(1, []byte{0x80, 0x3c, 0x20})
+	e.record(2, []byte{0x90, 0x40, 0x40})
+	e.record(2, []byte{0x90, 0x40, 0x40})
+	e.record(2, []byte{0x90, 0x42, 0x40})
+	// when
+	c := e.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterE{Logs: []NoteExtra{
+		{S: true, NoteNum: 0x3c, V: true, Value: 0x20},
+		{NoteNum: 0x40, Value: 0x02},
+	}}, c)
+}
+
+func Test_receiver_repairs_note_off_with_velocity(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0x90, 0x3c, 0x40}), s))
+	withJournal(message(2, now, []byte{0x80, 0x3c, 0x20}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0x80, 0x3c, 0x20}},
+	}, repair)
+}
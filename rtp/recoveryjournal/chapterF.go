@@ -0,0 +1,191 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|C|P|Q|D|POINT|  COMPLETE ...                                 |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |  ...          |  PARTIAL  ...                                 |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |  ...          |
+   +-+-+-+-+-+-+-+-+
+
+    Figure B.4.1 -- Chapter F format
+
+   In the quarter frame format, the nibbles of the pieces 0 to 7 are coded
+   from the most significant to the least significant nibble. In the full
+   frame format, the octets code the hours, minutes, seconds and frames.
+
+*/
+
+const (
+	chapterFSFlag     = 0x80
+	chapterFCFlag     = 0x40 // COMPLETE present
+	chapterFPFlag     = 0x20 // PARTIAL present
+	chapterFQFlag     = 0x10 // COMPLETE in quarter frame format
+	chapterFDFlag     = 0x08 // tape moves in reverse direction
+	chapterFPointMask = 0x07
+	chapterFFieldLen  = 4
+	quarterFrames     = 8
+)
+
+// ChapterF is responsible for MIDI Time Code Quarter Frame (0xF1) and
+// Full Frame (SysEx) commands.
+type ChapterF struct {
+	S bool
+	// HasComplete is true if Complete contains the time of the last complete frame.
+	HasComplete bool
+	Complete    uint32
+	// HasPartial is true if Partial contains the pieces received since the last complete frame.
+	HasPartial bool
+	Partial    uint32
+	Q          bool  // true if Complete is in the quarter frame format
+	D          bool  // true if the tape moves in reverse direction
+	Point      uint8 // the last quarter frame piece
+}
+
+func (c ChapterF) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterFSFlag) |
+		flag(c.HasComplete, chapterFCFlag) |
+		flag(c.HasPartial, chapterFPFlag) |
+		flag(c.Q, chapterFQFlag) |
+		flag(c.D, chapterFDFlag) |
+		c.Point&chapterFPointMask)
+	if c.HasComplete {
+		binary.Write(b, binary.BigEndian, c.Complete)
+	}
+	if c.HasPartial {
+		binary.Write(b, binary.BigEndian, c.Partial)
+	}
+}
+
+func decodeChapterF(buffer []byte) (c ChapterF, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter F header", ErrTruncated)
+	}
+	header := buffer[0]
+	c.S = header&chapterFSFlag != 0
+	c.HasComplete = header&chapterFCFlag != 0
+	c.HasPartial = header&chapterFPFlag != 0
+	c.Q = header&chapterFQFlag != 0
+	c.D = header&chapterFDFlag != 0
+	c.Point = header & chapterFPointMask
+	n = 1
+	for _, f := range []struct {
+		present bool
+		value   *uint32
+	}{{c.HasComplete, &c.Complete}, {c.HasPartial, &c.Partial}} {
+		if !f.present {
+			continue
+		}
+		if len(buffer) < n+chapterFFieldLen {
+			return c, n, fmt.Errorf("%w: chapter F", ErrTruncated)
+		}
+		*f.value = binary.BigEndian.Uint32(buffer[n:])
+		n += chapterFFieldLen
+	}
+	return
+}
+
+// fullFrame returns the hours, minutes, seconds and frames octets of the complete time.
+func (c ChapterF) fullFrame() []byte {
+	if !c.Q {
+		return []byte{byte(c.Complete >> 24), byte(c.Complete >> 16), byte(c.Complete >> 8), byte(c.Complete)}
+	}
+	piece := func(i uint) byte {
+		return byte(c.Complete>>(28-4*i)) & 0x0f
+	}
+	return []byte{
+		piece(6) | piece(7)<<4,
+		piece(4) | piece(5)<<4,
+		piece(2) | piece(3)<<4,
+		piece(0) | piece(1)<<4,
+	}
+}
+
+// fullFrameMessage returns the MIDI Time Code Full Frame SysEx of the given time.
+func fullFrameMessage(time []byte) rtp.MIDIPayload {
+	return append(append([]byte{sysExStart, 0x7f, 0x7f, 0x01, 0x01}, time...), sysExEnd)
+}
+
+// isFullFrame returns true if the payload is a MIDI Time Code Full Frame SysEx.
+func isFullFrame(p rtp.MIDIPayload) bool {
+	return len(p) == 10 && p[0] == sysExStart && p[1] == 0x7f && p[3] == 0x01 && p[4] == 0x01 && p[9] == sysExEnd
+}
+
+// timeCodeState tracks the MIDI Time Code commands of a stream
+type timeCodeState struct {
+	recorded    bool
+	seqNum      uint32
+	hasComplete bool
+	complete    uint32
+	quarter     bool // complete is in the quarter frame format
+	hasPartial  bool
+	pieces      [quarterFrames]uint8
+	point       uint8
+	reverse     bool
+}
+
+func (f *timeCodeState) record(seqNum uint32, p rtp.MIDIPayload) {
+	switch {
+	case p[0] == timeCodeQuarter && len(p) > 1:
+		piece, value := p[1]>>4&chapterFPointMask, p[1]&0x0f
+		if f.recorded {
+			switch piece {
+			case (f.point + 1) % quarterFrames:
+				f.reverse = false
+			case (f.point + quarterFrames - 1) % quarterFrames:
+				f.reverse = true
+			}
+		}
+		f.pieces[piece] = value
+		f.point = piece
+		f.hasPartial = true
+		if (!f.reverse && piece == quarterFrames-1) || (f.reverse && piece == 0) {
+			f.hasComplete, f.complete, f.quarter, f.hasPartial = true, f.packedPieces(), true, false
+		}
+	case isFullFrame(p):
+		f.hasComplete, f.complete, f.quarter, f.hasPartial = true, binary.BigEndian.Uint32(p[5:]), false, false
+	default:
+		return
+	}
+	f.recorded = true
+	f.seqNum = seqNum
+}
+
+func (f *timeCodeState) packedPieces() (packed uint32) {
+	for i, value := range f.pieces {
+		packed |= uint32(value) << (28 - 4*uint(i))
+	}
+	return
+}
+
+// chapter returns the Chapter F if the time code was changed since the checkpoint.
+func (f *timeCodeState) chapter(checkpoint, seqNum uint32) *ChapterF {
+	if !f.recorded || seqNumBefore(f.seqNum, checkpoint) {
+		return nil
+	}
+	c := ChapterF{
+		S:           f.seqNum != seqNum-1,
+		HasComplete: f.hasComplete,
+		Complete:    f.complete,
+		Q:           f.quarter,
+		D:           f.reverse,
+		Point:       f.point,
+		HasPartial:  f.hasPartial,
+	}
+	if f.hasPartial {
+		c.Partial = f.packedPieces()
+	}
+	return &c
+}
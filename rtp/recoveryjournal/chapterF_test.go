@@ -0,0 +1,52 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterF(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterF{S: true, HasComplete: true, Complete: 0x01020304, HasPartial: true, Partial: 0x50000000, Point: 1}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterF(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0xe1, 0x01, 0x02, 0x03, 0x04, 0x50, 0x00, 0x00, 0x00}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 9, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_timeCodeState_completes_quarter_frames(t *testing.T) {
+	// given
+	f := timeCodeState{}
+	for piece, value := range []byte{0x4, 0x1, 0x3, 0x0, 0x2, 0x0, 0x1, 0x2} {
+		f.record(1, []byte{0xf1, byte(piece)<<4 | value})
+	}
+	// when
+	c := f.chapter(1, 2)
+	// then
+	assert.Equal(t, &ChapterF{HasComplete: true, Complete: 0x41302012, Q: true, Point: 7}, c)
+	assert.Equal(t, []byte{0x21, 0x02, 0x03, 0x14}, c.fullFrame())
+}
+
+func Test_receiver_restores_time_code(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	fullFrame := []byte{0xf0, 0x7f, 0x7f, 0x01, 0x01, 0x21, 0x02, 0x03, 0x04, 0xf7}
+	r.Receive(withJournal(message(1, now, []byte{0xf8}), s))
+	withJournal(message(2, now, fullFrame), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: fullFrame}}, repair)
+}
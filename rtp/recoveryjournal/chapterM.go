@@ -0,0 +1,404 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|P|E|U|W|Z|      LENGTH       |Q|  PENDING    |  Log list ... |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                   Figure A.4.1 -- Chapter M format
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|   PNUM-LSB  |Q|   PNUM-MSB  |J|K|L|M|N|T|V|R| Fields ...    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                  Figure A.4.2 -- Parameter log format
+
+   The fields follow in the order of the J (ENTRY-MSB), K (ENTRY-LSB),
+   L (A-BUTTON, 2 octets), M (C-BUTTON, 2 octets) and N (COUNT) flags.
+
+*/
+
+const (
+	chapterMSFlag      = 0x8000
+	chapterMPFlag      = 0x4000 // PENDING octet present
+	chapterMEFlag      = 0x2000 // null function selected
+	chapterMUFlag      = 0x1000 // all logs code RPNs
+	chapterMWFlag      = 0x0800 // all logs code NRPNs
+	chapterMZFlag      = 0x0400 // all logs have PNUM-MSB 0
+	chapterMLengthMask = 0x03ff
+	chapterMHeaderLen  = 2
+	parameterSFlag     = 0x80
+	parameterQFlag     = 0x80   // NRPN instead of RPN
+	parameterJFlag     = 0x80   // ENTRY-MSB present
+	parameterKFlag     = 0x40   // ENTRY-LSB present
+	parameterLFlag     = 0x20   // A-BUTTON present
+	parameterMFlag     = 0x10   // C-BUTTON present
+	parameterNFlag     = 0x08   // COUNT present
+	buttonGFlag        = 0x8000 // decrement
+	buttonMask         = 0x3fff
+)
+
+// MIDI controllers of the parameter system
+const (
+	dataEntryMSB  = 6
+	dataEntryLSB  = 38
+	dataIncrement = 96
+	dataDecrement = 97
+	nrpnLSB       = 98
+	nrpnMSB       = 99
+	rpnLSB        = 100
+	rpnMSB        = 101
+	nullFunction  = 127
+)
+
+// ChapterM is responsible for the RPN and NRPN parameter system
+type ChapterM struct {
+	S bool
+	// Pending is true if the MSB of a parameter number was sent without the LSB.
+	Pending     bool
+	PendingNRPN bool
+	PendingMSB  uint8
+	// E is true if the null function was selected by the most recent transaction.
+	E bool
+	// U is true if all logs code RPNs, W if all logs code NRPNs.
+	U bool
+	W bool
+	// Z is true if all logs have a parameter number MSB of 0.
+	Z    bool
+	Logs []ParameterLog
+}
+
+// ParameterLog contains the state of a single RPN or NRPN parameter.
+type ParameterLog struct {
+	S         bool
+	NRPN      bool
+	NumberMSB uint8
+	NumberLSB uint8
+
+	HasEntryMSB bool
+	EntryMSB    uint8
+	HasEntryLSB bool
+	EntryLSB    uint8
+	// Buttons is the sum of the Data Increment (+1) and Data Decrement (-1)
+	// commands since the last Data Entry.
+	HasButtons bool
+	Buttons    int16
+	// Count is the number of transactions of this parameter (mod 128).
+	HasCount bool
+	Count    uint8
+}
+
+func (c ChapterM) encode(b *bytes.Buffer) error {
+	logs := new(bytes.Buffer)
+	if c.Pending {
+		logs.WriteByte(flag(c.PendingNRPN, parameterQFlag) | c.PendingMSB&noteLogValueMask)
+	}
+	for _, l := range c.Logs {
+		l.encode(logs)
+	}
+	length := chapterMHeaderLen + logs.Len()
+	if length > chapterMLengthMask {
+		return fmt.Errorf("chapter M is too long: %d octets", length)
+	}
+	header := uint16(length)
+	for _, f := range []struct {
+		set  bool
+		mask uint16
+	}{{c.S, chapterMSFlag}, {c.Pending, chapterMPFlag}, {c.E, chapterMEFlag}, {c.U, chapterMUFlag}, {c.W, chapterMWFlag}, {c.Z, chapterMZFlag}} {
+		if f.set {
+			header |= f.mask
+		}
+	}
+	binary.Write(b, binary.BigEndian, header)
+	b.Write(logs.Bytes())
+	return nil
+}
+
+func (l ParameterLog) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(l.S, parameterSFlag) | l.NumberLSB&noteLogValueMask)
+	b.WriteByte(flag(l.NRPN, parameterQFlag) | l.NumberMSB&noteLogValueMask)
+	toc := flag(l.HasEntryMSB, parameterJFlag) | flag(l.HasEntryLSB, parameterKFlag) |
+		flag(l.HasButtons, parameterLFlag) | flag(l.HasCount, parameterNFlag)
+	b.WriteByte(toc)
+	if l.HasEntryMSB {
+		b.WriteByte(l.EntryMSB & noteLogValueMask)
+	}
+	if l.HasEntryLSB {
+		b.WriteByte(l.EntryLSB & noteLogValueMask)
+	}
+	if l.HasButtons {
+		buttons := uint16(l.Buttons) & buttonMask
+		if l.Buttons < 0 {
+			buttons = uint16(-l.Buttons)&buttonMask | buttonGFlag
+		}
+		binary.Write(b, binary.BigEndian, buttons)
+	}
+	if l.HasCount {
+		b.WriteByte(l.Count & noteLogValueMask)
+	}
+}
+
+func decodeChapterM(buffer []byte) (c ChapterM, n int, err error) {
+	if len(buffer) < chapterMHeaderLen {
+		return c, 0, fmt.Errorf("%w: chapter M header", ErrTruncated)
+	}
+	header := binary.BigEndian.Uint16(buffer)
+	length := int(header & chapterMLengthMask)
+	if length < chapterMHeaderLen || len(buffer) < length {
+		return c, 0, fmt.Errorf("%w: chapter M of %d octets", ErrTruncated, length)
+	}
+	c.S = header&chapterMSFlag != 0
+	c.Pending = header&chapterMPFlag != 0
+	c.E = header&chapterMEFlag != 0
+	c.U = header&chapterMUFlag != 0
+	c.W = header&chapterMWFlag != 0
+	c.Z = header&chapterMZFlag != 0
+	n = chapterMHeaderLen
+	if c.Pending {
+		if length < n+1 {
+			return c, n, fmt.Errorf("%w: chapter M pending", ErrTruncated)
+		}
+		c.PendingNRPN = buffer[n]&parameterQFlag != 0
+		c.PendingMSB = buffer[n] & noteLogValueMask
+		n++
+	}
+	for n < length {
+		l, size, lErr := decodeParameterLog(buffer[n:length])
+		if lErr != nil {
+			return c, n, lErr
+		}
+		c.Logs = append(c.Logs, l)
+		n += size
+	}
+	return
+}
+
+func decodeParameterLog(buffer []byte) (l ParameterLog, n int, err error) {
+	if len(buffer) < 3 {
+		return l, 0, fmt.Errorf("%w: parameter log", ErrTruncated)
+	}
+	l.S = buffer[0]&parameterSFlag != 0
+	l.NumberLSB = buffer[0] & noteLogValueMask
+	l.NRPN = buffer[1]&parameterQFlag != 0
+	l.NumberMSB = buffer[1] & noteLogValueMask
+	toc := buffer[2]
+	size := 3
+	for _, f := range []struct {
+		mask byte
+		len  int
+	}{{parameterJFlag, 1}, {parameterKFlag, 1}, {parameterLFlag, 2}, {parameterMFlag, 2}, {parameterNFlag, 1}} {
+		if toc&f.mask != 0 {
+			size += f.len
+		}
+	}
+	if len(buffer) < size {
+		return l, 0, fmt.Errorf("%w: parameter log fields", ErrTruncated)
+	}
+	n = 3
+	if toc&parameterJFlag != 0 {
+		l.HasEntryMSB, l.EntryMSB = true, buffer[n]&noteLogValueMask
+		n++
+	}
+	if toc&parameterKFlag != 0 {
+		l.HasEntryLSB, l.EntryLSB = true, buffer[n]&noteLogValueMask
+		n++
+	}
+	if toc&parameterLFlag != 0 {
+		buttons := binary.BigEndian.Uint16(buffer[n:])
+		l.HasButtons, l.Buttons = true, int16(buttons&buttonMask)
+		if buttons&buttonGFlag != 0 {
+			l.Buttons = -l.Buttons
+		}
+		n += 2
+	}
+	if toc&parameterMFlag != 0 {
+		// the C-BUTTON field is not used
+		n += 2
+	}
+	if toc&parameterNFlag != 0 {
+		l.HasCount, l.Count = true, buffer[n]&noteLogValueMask
+		n++
+	}
+	return
+}
+
+// parameterController returns true for the controllers which are coded in Chapter M.
+func parameterController(number uint8) bool {
+	return number == dataEntryMSB || number == dataEntryLSB || (number >= dataIncrement && number <= rpnMSB)
+}
+
+type parameterNumber struct {
+	nrpn bool
+	msb  uint8
+	lsb  uint8
+}
+
+func (p parameterNumber) null() bool {
+	return p.msb == nullFunction && p.lsb == nullFunction
+}
+
+// parameterSelection tracks the parameter number selected with the RPN and NRPN controllers.
+type parameterSelection struct {
+	nrpn     bool
+	msb      uint8
+	lsb      uint8
+	msbSet   bool
+	lsbSet   bool
+	selected bool
+}
+
+// update changes the selection with a parameter controller and returns true
+// if a complete parameter number was selected.
+func (s *parameterSelection) update(number, value uint8) bool {
+	nrpn := number == nrpnLSB || number == nrpnMSB
+	if nrpn != s.nrpn {
+		*s = parameterSelection{nrpn: nrpn}
+	}
+	switch number {
+	case nrpnMSB, rpnMSB:
+		s.msb, s.msbSet, s.lsbSet = value, true, false
+	case nrpnLSB, rpnLSB:
+		s.lsb, s.lsbSet = value, true
+	}
+	s.selected = s.msbSet && s.lsbSet
+	return s.selected
+}
+
+func (s *parameterSelection) number() parameterNumber {
+	return parameterNumber{nrpn: s.nrpn, msb: s.msb, lsb: s.lsb}
+}
+
+// parameterState tracks the RPN and NRPN transactions of a channel
+type parameterState struct {
+	selection    parameterSelection
+	transactions uint32
+	seqNum       uint32 // sequence number of the most recent selection
+	logs         map[parameterNumber]*parameterLog
+}
+
+type parameterLog struct {
+	seqNum   uint32
+	order    uint32 // transaction number of the most recent selection
+	entryMSB *uint8
+	entryLSB *uint8
+	buttons  int16
+	count    uint8
+}
+
+func (p *parameterState) record(seqNum uint32, payload rtp.MIDIPayload) {
+	if payload[0]&0xf0 != controlChange || !parameterController(payload[1]) {
+		return
+	}
+	number, value := payload[1]&0x7f, payload[2]&0x7f
+	switch number {
+	case nrpnLSB, nrpnMSB, rpnLSB, rpnMSB:
+		p.seqNum = seqNum
+		if p.selection.update(number, value) && !p.selection.number().null() {
+			l := p.log(p.selection.number())
+			l.seqNum = seqNum
+			l.count++
+			p.transactions++
+			l.order = p.transactions
+		}
+		return
+	}
+	if !p.selection.selected || p.selection.number().null() {
+		return
+	}
+	l := p.log(p.selection.number())
+	l.seqNum = seqNum
+	switch number {
+	case dataEntryMSB:
+		l.entryMSB, l.entryLSB, l.buttons = &value, nil, 0
+	case dataEntryLSB:
+		l.entryLSB, l.buttons = &value, 0
+	case dataIncrement:
+		l.buttons++
+	case dataDecrement:
+		l.buttons--
+	}
+}
+
+func (p *parameterState) log(number parameterNumber) *parameterLog {
+	if p.logs == nil {
+		p.logs = map[parameterNumber]*parameterLog{}
+	}
+	l, found := p.logs[number]
+	if !found {
+		l = &parameterLog{}
+		p.logs[number] = l
+	}
+	return l
+}
+
+// chapter returns the Chapter M for the parameters changed since the checkpoint
+// or nil if the parameter system was not used since. The most recently selected
+// parameter is coded last.
+func (p *parameterState) chapter(checkpoint, seqNum uint32) *ChapterM {
+	selectionChanged := p.selection.msbSet && !seqNumBefore(p.seqNum, checkpoint)
+	type entry struct {
+		number parameterNumber
+		log    *parameterLog
+	}
+	entries := []entry{}
+	for number, l := range p.logs {
+		if !seqNumBefore(l.seqNum, checkpoint) {
+			entries = append(entries, entry{number, l})
+		}
+	}
+	if len(entries) == 0 && !selectionChanged {
+		return nil
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].log.order < entries[j].log.order
+	})
+
+	c := ChapterM{S: !selectionChanged || p.seqNum != seqNum-1, U: true, W: true, Z: true}
+	if selectionChanged {
+		if p.selection.msbSet && !p.selection.lsbSet {
+			c.Pending, c.PendingNRPN, c.PendingMSB = true, p.selection.nrpn, p.selection.msb
+		}
+		c.E = p.selection.selected && p.selection.number().null()
+	}
+	for _, e := range entries {
+		l := ParameterLog{
+			S:          e.log.seqNum != seqNum-1,
+			NRPN:       e.number.nrpn,
+			NumberMSB:  e.number.msb,
+			NumberLSB:  e.number.lsb,
+			HasButtons: e.log.buttons != 0,
+			Buttons:    e.log.buttons,
+			HasCount:   true,
+			Count:      e.log.count & noteLogValueMask,
+		}
+		if e.log.entryMSB != nil {
+			l.HasEntryMSB, l.EntryMSB = true, *e.log.entryMSB
+		}
+		if e.log.entryLSB != nil {
+			l.HasEntryLSB, l.EntryLSB = true, *e.log.entryLSB
+		}
+		c.S = c.S && l.S
+		c.U = c.U && !l.NRPN
+		c.W = c.W && l.NRPN
+		c.Z = c.Z && l.NumberMSB == 0
+		c.Logs = append(c.Logs, l)
+	}
+	if len(c.Logs) == 0 {
+		c.U, c.W, c.Z = false, false, false
+	}
+	return &c
+}
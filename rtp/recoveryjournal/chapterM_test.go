@@ -0,0 +1,107 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterM(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterM{
+		S:           true,
+		Pending:     true,
+		PendingNRPN: true,
+		PendingMSB:  0x10,
+		U:           true,
+		Z:           true,
+		Logs: []ParameterLog{
+			{S: true, NumberLSB: 0x00, HasEntryMSB: true, EntryMSB: 0x0c, HasCount: true, Count: 1},
+			{NumberLSB: 0x01, HasEntryMSB: true, EntryMSB: 0x40, HasEntryLSB: true, EntryLSB: 0x10, HasButtons: true, Buttons: -2},
+		},
+	}
+	// when
+	err := c.encode(b)
+	actual, n, dErr := decodeChapterM(b.Bytes())
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0xd4, 0x0f, // Header (S, P, U, Z, LENGTH=15)
+		0x90,             // Pending NRPN MSB
+		0x80, 0x00, 0x88, // Log (S, RPN 0/0, J, N)
+		0x0c, 0x01, // ENTRY-MSB, COUNT
+		0x01, 0x00, 0xe0, // Log (RPN 0/1, J, K, L)
+		0x40, 0x10, 0x80, 0x02, // ENTRY-MSB, ENTRY-LSB, A-BUTTON (G)
+	}, b.Bytes())
+	assert.Nil(t, dErr)
+	assert.Equal(t, b.Len(), n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_parameterState_tracks_data_entry(t *testing.T) {
+	// given
+	p := parameterState{}
+	p.record(1, []byte{0xb0, 0x65, 0x00})
+	p.record(1, []byte{0xb0, 0x64, 0x00})
+	p.record(1, []byte{0xb0, 0x06, 0x0c})
+	p.record(2, []byte{0xb0, 0x63, 0x01})
+	p.record(2, []byte{0xb0, 0x62, 0x02})
+	p.record(2, []byte{0xb0, 0x26, 0x03})
+	p.record(2, []byte{0xb0, 0x60, 0x00})
+	// when
+	c := p.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterM{Logs: []ParameterLog{
+		{S: true, NumberMSB: 0x00, NumberLSB: 0x00, HasEntryMSB: true, EntryMSB: 0x0c, HasCount: true, Count: 1},
+		{NRPN: true, NumberMSB: 0x01, NumberLSB: 0x02, HasEntryLSB: true, EntryLSB: 0x03, HasButtons: true, Buttons: 1, HasCount: true, Count: 1},
+	}}, c)
+}
+
+func Test_parameterState_tracks_null_function(t *testing.T) {
+	// given
+	p := parameterState{}
+	p.record(1, []byte{0xb0, 0x65, 0x00})
+	p.record(1, []byte{0xb0, 0x64, 0x00})
+	p.record(1, []byte{0xb0, 0x06, 0x0c})
+	p.record(1, []byte{0xb0, 0x65, 0x7f})
+	p.record(1, []byte{0xb0, 0x64, 0x7f})
+	// when
+	c := p.chapter(1, 3)
+	// then
+	assert.True(t, c.E)
+	assert.Len(t, c.Logs, 1)
+}
+
+func Test_parameter_controllers_are_not_in_chapterC(t *testing.T) {
+	// given
+	c := controllerState{}
+	// when
+	c.record(1, []byte{0xb0, 0x65, 0x00})
+	c.record(1, []byte{0xb0, 0x06, 0x0c})
+	// then
+	assert.Nil(t, c.chapter(1, 2, false))
+}
+
+func Test_receiver_restores_parameters(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xb0, 0x65, 0x00}, []byte{0xb0, 0x64, 0x00}, []byte{0xb0, 0x06, 0x02}), s))
+	withJournal(message(2, now, []byte{0xb0, 0x06, 0x0c}, []byte{0xb0, 0x65, 0x7f}, []byte{0xb0, 0x64, 0x7f}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xb0, 0x65, 0x00}},
+		{Payload: []byte{0xb0, 0x64, 0x00}},
+		{Payload: []byte{0xb0, 0x06, 0x0c}},
+		{Payload: []byte{0xb0, 0x65, 0x7f}},
+		{Payload: []byte{0xb0, 0x64, 0x7f}},
+	}, repair)
+}
@@ -1,5 +1,13 @@
 package recoveryjournal
 
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
 /*
 
     0                   1                   2                   3
@@ -16,12 +24,25 @@ package recoveryjournal
 
 */
 
+const (
+	chapterNBFlag    = 0x80 // S bit of the OFFBITS
+	chapterNLenMask  = 0x7f // number of note logs
+	chapterNMaxLen   = 127  // together with LOW=15 and HIGH=0 codes 128 note logs
+	chapterNNoLow    = 15   // LOW > HIGH codes no OFFBITS
+	chapterNNoHigh   = 1    // LOW > HIGH codes no OFFBITS
+	noteLogSFlag     = 0x80
+	noteLogYFlag     = 0x80
+	noteLogValueMask = 0x7f
+)
+
+// playRecommendationWindow defines how old a NoteOn may be to be still played by the receiver.
+const playRecommendationWindow = 100 * time.Millisecond
+
 // ChapterN is responsible for MIDI NoteOff (0x8), NoteOn (0x9) commands
 type ChapterN struct {
-	NoteSeqNumber uint32    // most recent note seqnum, or 0
-	NoteTimestamp uint32    // NoteOn execution timestamp
-	NoteOn        []NoteOn  // Max. 128 NoteOn messages
-	NoteOff       []NoteOff // Max. 16 OffBit messages
+	B       bool      // S bit of the OFFBITS: false if a NoteOff was sent in the previous packet
+	NoteOn  []NoteOn  // Max. 128 NoteOn messages
+	NoteOff []NoteOff // Notes which were turned off since the checkpoint
 }
 
 // NoteOn containst the last NoteOn data for a note
@@ -36,11 +57,170 @@ type ChapterN struct {
  Figure A.6.3 -- Chapter N Note Log
 */
 type NoteOn struct {
+	S                  bool // false if the NoteOn was sent in the previous packet
 	NoteNum            uint8
 	Velocity           uint8 // never 0
 	PlayRecommendation bool  // Y=1: play Y=0: skip
 }
+
 // NoteOff contains information about NoteOff
 type NoteOff struct {
 	NoteNum uint8
 }
+
+func (c ChapterN) encode(b *bytes.Buffer) {
+	low, high := byte(chapterNNoLow), byte(chapterNNoHigh)
+	var offbits [16]byte
+	for _, off := range c.NoteOff {
+		octet := off.NoteNum >> 3
+		offbits[octet] |= 0x80 >> (off.NoteNum & 0x07)
+		if low > high {
+			low, high = octet, octet
+		}
+		if octet < low {
+			low = octet
+		}
+		if octet > high {
+			high = octet
+		}
+	}
+
+	header := byte(len(c.NoteOn))
+	if len(c.NoteOn) > chapterNMaxLen {
+		header = chapterNMaxLen
+		low, high = chapterNNoLow, 0
+	}
+	if c.B {
+		header |= chapterNBFlag
+	}
+	b.WriteByte(header)
+	b.WriteByte(low<<4 | high)
+
+	for _, on := range c.NoteOn {
+		notenum := on.NoteNum & noteLogValueMask
+		if on.S {
+			notenum |= noteLogSFlag
+		}
+		velocity := on.Velocity & noteLogValueMask
+		if on.PlayRecommendation {
+			velocity |= noteLogYFlag
+		}
+		b.WriteByte(notenum)
+		b.WriteByte(velocity)
+	}
+
+	if low <= high {
+		b.Write(offbits[low : high+1])
+	}
+}
+
+func decodeChapterN(buffer []byte) (c ChapterN, n int, err error) {
+	if len(buffer) < 2 {
+		return c, 0, fmt.Errorf("%w: chapter N header", ErrTruncated)
+	}
+	c.B = buffer[0]&chapterNBFlag != 0
+	logs := int(buffer[0] & chapterNLenMask)
+	low, high := buffer[1]>>4, buffer[1]&0x0f
+	if logs == chapterNMaxLen && low == chapterNNoLow && high == 0 {
+		logs = chapterNMaxLen + 1
+	}
+	n = 2
+	if len(buffer) < n+2*logs {
+		return c, n, fmt.Errorf("%w: chapter N note logs", ErrTruncated)
+	}
+	for i := 0; i < logs; i++ {
+		c.NoteOn = append(c.NoteOn, NoteOn{
+			S:                  buffer[n]&noteLogSFlag != 0,
+			NoteNum:            buffer[n] & noteLogValueMask,
+			Velocity:           buffer[n+1] & noteLogValueMask,
+			PlayRecommendation: buffer[n+1]&noteLogYFlag != 0,
+		})
+		n += 2
+	}
+	if low <= high {
+		if len(buffer) < n+int(high-low)+1 {
+			return c, n, fmt.Errorf("%w: chapter N offbits", ErrTruncated)
+		}
+		for octet := low; octet <= high; octet++ {
+			for bit := uint8(0); bit < 8; bit++ {
+				if buffer[n]&(0x80>>bit) != 0 {
+					c.NoteOff = append(c.NoteOff, NoteOff{NoteNum: octet<<3 | bit})
+				}
+			}
+			n++
+		}
+	}
+	return
+}
+
+// noteState tracks the NoteOn and NoteOff commands of a channel
+type noteState struct {
+	notes [128]noteLog
+}
+
+type noteLog struct {
+	recorded bool
+	seqNum   uint32 // extended sequence number of the most recent command
+	on       bool
+	velocity uint8
+	time     time.Time // execution time of the NoteOn
+}
+
+func (n *noteState) record(seqNum uint32, t time.Time, p rtp.MIDIPayload) {
+	switch p[0] & 0xf0 {
+	case noteOff:
+		n.update(seqNum, t, p[1], 0)
+	case noteOn:
+		n.update(seqNum, t, p[1], p[2])
+	case controlChange:
+		if p[1] == allSoundOff || p[1] >= allNotesOff {
+			n.allOff(seqNum, t)
+		}
+	}
+}
+
+func (n *noteState) update(seqNum uint32, t time.Time, note, velocity uint8) {
+	l := &n.notes[note&0x7f]
+	l.recorded = true
+	l.seqNum = seqNum
+	l.on = velocity > 0
+	l.velocity = velocity
+	l.time = t
+}
+
+func (n *noteState) allOff(seqNum uint32, t time.Time) {
+	for note, l := range n.notes {
+		if l.recorded && l.on {
+			n.update(seqNum, t, uint8(note), 0)
+		}
+	}
+}
+
+// chapter returns the Chapter N for the commands sent since the checkpoint
+// or nil if no note command was sent since.
+func (n *noteState) chapter(checkpoint, seqNum uint32, now time.Time) *ChapterN {
+	c := ChapterN{B: true}
+	for note, l := range n.notes {
+		if !l.recorded || seqNumBefore(l.seqNum, checkpoint) {
+			continue
+		}
+		previous := l.seqNum == seqNum-1
+		if l.on {
+			c.NoteOn = append(c.NoteOn, NoteOn{
+				S:                  !previous,
+				NoteNum:            uint8(note),
+				Velocity:           l.velocity,
+				PlayRecommendation: now.Sub(l.time) < playRecommendationWindow,
+			})
+		} else {
+			c.NoteOff = append(c.NoteOff, NoteOff{NoteNum: uint8(note)})
+			if previous {
+				c.B = false
+			}
+		}
+	}
+	if len(c.NoteOn) == 0 && len(c.NoteOff) == 0 {
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,106 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_encode_of_chapterN(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterN{
+		B: true,
+		NoteOn: []NoteOn{
+			{S: true, NoteNum: 0x3c, Velocity: 0x40, PlayRecommendation: true},
+			{S: false, NoteNum: 0x40, Velocity: 0x50},
+		},
+		NoteOff: []NoteOff{{NoteNum: 0x3e}, {NoteNum: 0x48}},
+	}
+	// when
+	c.encode(b)
+	/* then
+
+	    0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 8 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |B|     LEN     |  LOW  | HIGH  |S|   NOTENUM   |Y|  VELOCITY   |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |1|0 0 0 0 0 1 0|0 1 1 1|1 0 0 1|1|    0x3c     |1|    0x40     |
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+	*/
+	assert.Equal(t, []byte{
+		0x82, 0x79, // Header
+		0xbc, 0xc0, // NoteOn log (S, Y)
+		0x40, 0x50, // NoteOn log
+		0x02, 0x00, 0x80, // OFFBITS (0x3e, 0x48)
+	}, b.Bytes())
+}
+
+func Test_encode_of_chapterN_without_offbits(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterN{NoteOn: []NoteOn{{NoteNum: 0x3c, Velocity: 0x40}}}
+	// when
+	c.encode(b)
+	// then
+	assert.Equal(t, []byte{0x01, 0xf1, 0x3c, 0x40}, b.Bytes())
+}
+
+func Test_encode_of_chapterN_with_128_notes(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterN{B: true}
+	for note := 0; note < 128; note++ {
+		c.NoteOn = append(c.NoteOn, NoteOn{NoteNum: uint8(note), Velocity: 0x40})
+	}
+	// when
+	c.encode(b)
+	// then
+	assert.Equal(t, 2+256, b.Len())
+	assert.Equal(t, []byte{0xff, 0xf0}, b.Bytes()[:2])
+}
+
+func Test_noteState_tracks_last_command_per_note(t *testing.T) {
+	// given
+	now := time.Now()
+	n := noteState{}
+	n.record(1, now, []byte{0x90, 0x3c, 0x40})
+	n.record(1, now, []byte{0x90, 0x3e, 0x40})
+	n.record(2, now, []byte{0x80, 0x3c, 0x00})
+	n.record(2, now, []byte{0x90, 0x40, 0x00})
+	// when
+	c := n.chapter(1, 3, now)
+	// then
+	assert.Equal(t, &ChapterN{
+		B:       false,
+		NoteOn:  []NoteOn{{S: true, NoteNum: 0x3e, Velocity: 0x40, PlayRecommendation: true}},
+		NoteOff: []NoteOff{{NoteNum: 0x3c}, {NoteNum: 0x40}},
+	}, c)
+}
+
+func Test_noteState_ignores_commands_before_checkpoint(t *testing.T) {
+	// given
+	now := time.Now()
+	n := noteState{}
+	n.record(1, now, []byte{0x90, 0x3c, 0x40})
+	// when
+	c := n.chapter(2, 3, now)
+	// then
+	assert.Nil(t, c)
+}
+
+func Test_all_notes_off(t *testing.T) {
+	// given
+	now := time.Now()
+	n := noteState{}
+	n.record(1, now, []byte{0x90, 0x3c, 0x40})
+	n.record(2, now, []byte{0xb0, 0x7b, 0x00})
+	// when
+	c := n.chapter(1, 10, now.Add(time.Second))
+	// then
+	assert.Equal(t, &ChapterN{B: true, NoteOff: []NoteOff{{NoteNum: 0x3c}}}, c)
+}
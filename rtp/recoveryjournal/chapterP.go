@@ -0,0 +1,117 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|   PROGRAM   |B|   BANK-MSB  |X|  BANK-LSB   |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+               Figure A.2.1 -- Chapter P format
+
+*/
+
+const (
+	chapterPLen   = 3
+	chapterPSFlag = 0x80
+	chapterPBFlag = 0x80 // bank select values are valid
+	chapterPXFlag = 0x80 // bank select values were reset
+)
+
+// ChapterP is responsible for MIDI Program Change (0xC) commands
+type ChapterP struct {
+	S       bool
+	Program uint8
+	// B is true if a Bank Select preceded the Program Change.
+	B       bool
+	BankMSB uint8
+	// X is true if a Reset All Controllers was sent between the Bank Select and
+	// the Program Change.
+	X       bool
+	BankLSB uint8
+}
+
+func (c ChapterP) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterPSFlag) | c.Program&noteLogValueMask)
+	b.WriteByte(flag(c.B, chapterPBFlag) | c.BankMSB&noteLogValueMask)
+	b.WriteByte(flag(c.X, chapterPXFlag) | c.BankLSB&noteLogValueMask)
+}
+
+func decodeChapterP(buffer []byte) (c ChapterP, n int, err error) {
+	if len(buffer) < chapterPLen {
+		return c, 0, fmt.Errorf("%w: chapter P", ErrTruncated)
+	}
+	c.S, c.Program = buffer[0]&chapterPSFlag != 0, buffer[0]&noteLogValueMask
+	c.B, c.BankMSB = buffer[1]&chapterPBFlag != 0, buffer[1]&noteLogValueMask
+	c.X, c.BankLSB = buffer[2]&chapterPXFlag != 0, buffer[2]&noteLogValueMask
+	return c, chapterPLen, nil
+}
+
+// programState tracks the Program Change commands of a channel and the
+// Bank Select controllers which were in effect.
+type programState struct {
+	recorded bool
+	seqNum   uint32
+	program  uint8
+	bank     bool
+	bankMSB  uint8
+	bankLSB  uint8
+	reset    bool
+	// pending contains the Bank Select state which will be captured by the next Program Change.
+	pendingBank  bool
+	pendingReset bool
+	pendingMSB   uint8
+	pendingLSB   uint8
+}
+
+func (p *programState) record(seqNum uint32, payload rtp.MIDIPayload) {
+	switch payload[0] & 0xf0 {
+	case controlChange:
+		switch payload[1] {
+		case bankSelectMSB:
+			p.pendingBank, p.pendingReset = true, false
+			p.pendingMSB = payload[2] & 0x7f
+		case bankSelectLSB:
+			p.pendingBank, p.pendingReset = true, false
+			p.pendingLSB = payload[2] & 0x7f
+		case resetAllControllers:
+			p.pendingReset = p.pendingBank
+		}
+	case programChange:
+		p.recorded = true
+		p.seqNum = seqNum
+		p.program = payload[1] & 0x7f
+		p.bank, p.reset = p.pendingBank, p.pendingReset
+		p.bankMSB, p.bankLSB = p.pendingMSB, p.pendingLSB
+	}
+}
+
+// chapter returns the Chapter P if a program was changed since the checkpoint.
+func (p *programState) chapter(checkpoint, seqNum uint32) *ChapterP {
+	if !p.recorded || seqNumBefore(p.seqNum, checkpoint) {
+		return nil
+	}
+	return &ChapterP{
+		S:       p.seqNum != seqNum-1,
+		Program: p.program,
+		B:       p.bank,
+		BankMSB: p.bankMSB,
+		X:       p.reset,
+		BankLSB: p.bankLSB,
+	}
+}
+
+func flag(set bool, mask byte) byte {
+	if set {
+		return mask
+	}
+	return 0
+}
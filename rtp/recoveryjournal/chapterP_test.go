@@ -0,0 +1,67 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterP(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterP{S: true, Program: 0x05, B: true, BankMSB: 0x01, BankLSB: 0x02}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterP(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x85, 0x81, 0x02}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_programState_captures_bank_select(t *testing.T) {
+	// given
+	p := programState{}
+	p.record(1, []byte{0xb0, 0x00, 0x01})
+	p.record(1, []byte{0xb0, 0x20, 0x02})
+	p.record(2, []byte{0xc0, 0x05})
+	// when
+	c := p.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterP{Program: 0x05, B: true, BankMSB: 0x01, BankLSB: 0x02}, c)
+}
+
+func Test_programState_marks_reset_bank_select(t *testing.T) {
+	// given
+	p := programState{}
+	p.record(1, []byte{0xb0, 0x00, 0x01})
+	p.record(1, []byte{0xb0, 0x79, 0x00})
+	p.record(1, []byte{0xc0, 0x05})
+	// when
+	c := p.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterP{S: true, Program: 0x05, B: true, BankMSB: 0x01, X: true}, c)
+}
+
+func Test_receiver_restores_program_and_pitch_wheel(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xc1, 0x01}), s))
+	withJournal(message(2, now, []byte{0xb1, 0x00, 0x03}, []byte{0xc1, 0x07}, []byte{0xe1, 0x00, 0x50}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xb1, 0x00, 0x03}},
+		{Payload: []byte{0xb1, 0x20, 0x00}},
+		{Payload: []byte{0xc1, 0x07}},
+		{Payload: []byte{0xe1, 0x00, 0x50}},
+	}, repair)
+}
@@ -0,0 +1,144 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|N|D|C|T| TOP |            CLOCK              |  TIMETOOLS ... |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+    Figure B.3.1 -- Chapter Q format
+
+*/
+
+const (
+	chapterQSFlag    = 0x80
+	chapterQNFlag    = 0x40 // sequencer is running
+	chapterQDFlag    = 0x20 // no Clock since the song position was set
+	chapterQCFlag    = 0x10 // CLOCK present
+	chapterQTFlag    = 0x08 // TIMETOOLS present
+	chapterQTopMask  = 0x07
+	chapterQClockLen = 2
+	chapterQToolsLen = 3
+	songClockMask    = 0x7ffff // 19 bit song position in MIDI clocks
+	clocksPerBeat    = 6       // MIDI clocks per Song Position Pointer unit
+)
+
+// ChapterQ is responsible for the MIDI sequencer commands Clock (0xF8), Start (0xFA),
+// Continue (0xFB), Stop (0xFC) and Song Position Pointer (0xF2).
+type ChapterQ struct {
+	S bool
+	N bool // true if the sequencer is running
+	D bool // true if no Clock was executed since the song position was set
+	// HasClock is true if Clock contains the song position in MIDI clocks.
+	HasClock bool
+	Clock    uint32
+	// HasTimeTools is true if the 24 bit TIMETOOLS field is present.
+	HasTimeTools bool
+	TimeTools    uint32
+}
+
+func (c ChapterQ) encode(b *bytes.Buffer) {
+	header := flag(c.S, chapterQSFlag) |
+		flag(c.N, chapterQNFlag) |
+		flag(c.D, chapterQDFlag) |
+		flag(c.HasClock, chapterQCFlag) |
+		flag(c.HasTimeTools, chapterQTFlag)
+	if c.HasClock {
+		header |= byte(c.Clock>>16) & chapterQTopMask
+	}
+	b.WriteByte(header)
+	if c.HasClock {
+		binary.Write(b, binary.BigEndian, uint16(c.Clock))
+	}
+	if c.HasTimeTools {
+		b.Write([]byte{byte(c.TimeTools >> 16), byte(c.TimeTools >> 8), byte(c.TimeTools)})
+	}
+}
+
+func decodeChapterQ(buffer []byte) (c ChapterQ, n int, err error) {
+	if len(buffer) < 1 {
+		return c, 0, fmt.Errorf("%w: chapter Q header", ErrTruncated)
+	}
+	header := buffer[0]
+	c.S = header&chapterQSFlag != 0
+	c.N = header&chapterQNFlag != 0
+	c.D = header&chapterQDFlag != 0
+	c.HasClock = header&chapterQCFlag != 0
+	c.HasTimeTools = header&chapterQTFlag != 0
+	n = 1
+	if c.HasClock {
+		if len(buffer) < n+chapterQClockLen {
+			return c, n, fmt.Errorf("%w: chapter Q clock", ErrTruncated)
+		}
+		c.Clock = uint32(header&chapterQTopMask)<<16 | uint32(binary.BigEndian.Uint16(buffer[n:]))
+		n += chapterQClockLen
+	}
+	if c.HasTimeTools {
+		if len(buffer) < n+chapterQToolsLen {
+			return c, n, fmt.Errorf("%w: chapter Q time tools", ErrTruncated)
+		}
+		c.TimeTools = uint32(buffer[n])<<16 | uint32(buffer[n+1])<<8 | uint32(buffer[n+2])
+		n += chapterQToolsLen
+	}
+	return
+}
+
+// sequencerState tracks the sequencer commands of a stream
+type sequencerState struct {
+	recorded bool
+	seqNum   uint32
+	running  bool
+	downbeat bool
+	position uint32 // song position in MIDI clocks
+}
+
+func (q *sequencerState) record(seqNum uint32, p rtp.MIDIPayload) {
+	switch p[0] {
+	case sequencerStart:
+		q.running, q.downbeat, q.position = true, true, 0
+	case sequencerResume:
+		q.running = true
+	case sequencerStop:
+		q.running = false
+	case timingClock:
+		if !q.running {
+			return
+		}
+		q.downbeat = false
+		q.position = (q.position + 1) & songClockMask
+	case songPosition:
+		if len(p) < 3 {
+			return
+		}
+		q.downbeat = true
+		q.position = (uint32(p[1]&systemDataMask) | uint32(p[2]&systemDataMask)<<7) * clocksPerBeat
+	default:
+		return
+	}
+	q.recorded = true
+	q.seqNum = seqNum
+}
+
+// chapter returns the Chapter Q if the sequencer state was changed since the checkpoint.
+func (q *sequencerState) chapter(checkpoint, seqNum uint32) *ChapterQ {
+	if !q.recorded || seqNumBefore(q.seqNum, checkpoint) {
+		return nil
+	}
+	return &ChapterQ{
+		S:        q.seqNum != seqNum-1,
+		N:        q.running,
+		D:        q.downbeat,
+		HasClock: true,
+		Clock:    q.position,
+	}
+}
@@ -0,0 +1,55 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterQ(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterQ{S: true, N: true, HasClock: true, Clock: 0x12345, HasTimeTools: true, TimeTools: 0x010203}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterQ(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0xd9, 0x23, 0x45, 0x01, 0x02, 0x03}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_sequencerState_tracks_song_position(t *testing.T) {
+	// given
+	q := sequencerState{}
+	q.record(1, []byte{0xf2, 0x02, 0x00})
+	q.record(1, []byte{0xf8})
+	q.record(1, []byte{0xfb})
+	q.record(2, []byte{0xf8})
+	q.record(2, []byte{0xf8})
+	// when
+	c := q.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterQ{N: true, HasClock: true, Clock: 14}, c)
+}
+
+func Test_receiver_restores_sequencer(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xfa}, []byte{0xf8}), s))
+	withJournal(message(2, now, []byte{0xf8}, []byte{0xfc}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xf2, 0x00, 0x00}},
+		{Payload: []byte{0xfc}},
+	}, repair)
+}
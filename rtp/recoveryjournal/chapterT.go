@@ -0,0 +1,67 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0
+    0 1 2 3 4 5 6 7
+   +-+-+-+-+-+-+-+-+
+   |S|   PRESSURE  |
+   +-+-+-+-+-+-+-+-+
+
+    Figure A.8.1 -- Chapter T format
+
+*/
+
+const (
+	chapterTLen   = 1
+	chapterTSFlag = 0x80
+)
+
+// ChapterT is responsible for MIDI Channel Aftertouch (0xD) commands
+type ChapterT struct {
+	S        bool
+	Pressure uint8
+}
+
+func (c ChapterT) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterTSFlag) | c.Pressure&noteLogValueMask)
+}
+
+func decodeChapterT(buffer []byte) (c ChapterT, n int, err error) {
+	if len(buffer) < chapterTLen {
+		return c, 0, fmt.Errorf("%w: chapter T", ErrTruncated)
+	}
+	c.S, c.Pressure = buffer[0]&chapterTSFlag != 0, buffer[0]&noteLogValueMask
+	return c, chapterTLen, nil
+}
+
+// channelPressureState tracks the Channel Aftertouch commands of a channel
+type channelPressureState struct {
+	recorded bool
+	seqNum   uint32
+	pressure uint8
+}
+
+func (a *channelPressureState) record(seqNum uint32, p rtp.MIDIPayload) {
+	if p[0]&0xf0 != channelAftertouch {
+		return
+	}
+	a.recorded = true
+	a.seqNum = seqNum
+	a.pressure = p[1] & 0x7f
+}
+
+// chapter returns the Chapter T if the channel pressure was changed since the checkpoint.
+func (a *channelPressureState) chapter(checkpoint, seqNum uint32) *ChapterT {
+	if !a.recorded || seqNumBefore(a.seqNum, checkpoint) {
+		return nil
+	}
+	return &ChapterT{S: a.seqNum != seqNum-1, Pressure: a.pressure}
+}
@@ -0,0 +1,40 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterT(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterT{S: true, Pressure: 0x30}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterT(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0xb0}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_receiver_restores_channel_pressure(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xd0, 0x10}), s))
+	withJournal(message(2, now, []byte{0xd0, 0x20}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{
+		{Payload: []byte{0xd0, 0x20}},
+	}, repair)
+}
@@ -0,0 +1,62 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0
+    0 1 2 3 4 5 6 7
+   +-+-+-+-+-+-+-+-+
+   |S|    COUNT    |
+   +-+-+-+-+-+-+-+-+
+
+    Figure B.2.1 -- Chapter V format
+
+*/
+
+const (
+	chapterVLen   = 1
+	chapterVSFlag = 0x80
+)
+
+// ChapterV is responsible for MIDI Active Sense (0xFE) commands
+type ChapterV struct {
+	S     bool
+	Count uint8 // Number of Active Sense commands (modulo 128)
+}
+
+func (c ChapterV) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterVSFlag) | c.Count&systemDataMask)
+}
+
+func decodeChapterV(buffer []byte) (c ChapterV, n int, err error) {
+	if len(buffer) < chapterVLen {
+		return c, 0, fmt.Errorf("%w: chapter V", ErrTruncated)
+	}
+	c.S, c.Count = buffer[0]&chapterVSFlag != 0, buffer[0]&systemDataMask
+	return c, chapterVLen, nil
+}
+
+// activeSenseState tracks the Active Sense commands of a stream
+type activeSenseState struct {
+	commandLog
+}
+
+func (a *activeSenseState) record(seqNum uint32, p rtp.MIDIPayload) {
+	if p[0] == activeSense {
+		a.update(seqNum)
+	}
+}
+
+// chapter returns the Chapter V if Active Sense was sent since the checkpoint.
+func (a *activeSenseState) chapter(checkpoint, seqNum uint32) *ChapterV {
+	if !a.recorded || seqNumBefore(a.seqNum, checkpoint) {
+		return nil
+	}
+	return &ChapterV{S: a.seqNum != seqNum-1, Count: a.count & systemDataMask}
+}
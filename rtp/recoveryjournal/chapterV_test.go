@@ -0,0 +1,68 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterV(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterV{S: true, Count: 0x12}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterV(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x92}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_activeSenseState_counts_active_sense(t *testing.T) {
+	// given
+	a := activeSenseState{}
+	a.record(1, []byte{0xfe})
+	a.record(1, []byte{0xf8})
+	a.record(2, []byte{0xfe})
+	// when
+	c := a.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterV{Count: 2}, c)
+}
+
+func Test_activeSenseState_count_wraps_at_128(t *testing.T) {
+	// given
+	a := activeSenseState{}
+	for i := 0; i < 130; i++ {
+		a.record(2, []byte{0xfe})
+	}
+	// when
+	c := a.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterV{Count: 2}, c)
+}
+
+func Test_activeSenseState_sets_S_bit_for_older_commands(t *testing.T) {
+	// given
+	a := activeSenseState{}
+	a.record(1, []byte{0xfe})
+	// when
+	c := a.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterV{S: true, Count: 1}, c)
+}
+
+func Test_activeSenseState_omits_commands_before_checkpoint(t *testing.T) {
+	// given
+	empty := activeSenseState{}
+	a := activeSenseState{}
+	a.record(1, []byte{0xfe})
+	// when
+	c := a.chapter(2, 3)
+	// then
+	assert.Nil(t, c)
+	assert.Nil(t, empty.chapter(1, 3))
+}
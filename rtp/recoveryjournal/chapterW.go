@@ -0,0 +1,71 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|     FIRST   |R|    SECOND   |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+    Figure A.5.1 -- Chapter W format
+
+*/
+
+const (
+	chapterWLen   = 2
+	chapterWSFlag = 0x80
+)
+
+// ChapterW is responsible for MIDI Pitch Wheel (0xE) commands
+type ChapterW struct {
+	S      bool
+	First  uint8 // least significant 7 bits
+	Second uint8 // most significant 7 bits
+}
+
+func (c ChapterW) encode(b *bytes.Buffer) {
+	b.WriteByte(flag(c.S, chapterWSFlag) | c.First&noteLogValueMask)
+	b.WriteByte(c.Second & noteLogValueMask)
+}
+
+func decodeChapterW(buffer []byte) (c ChapterW, n int, err error) {
+	if len(buffer) < chapterWLen {
+		return c, 0, fmt.Errorf("%w: chapter W", ErrTruncated)
+	}
+	c.S, c.First = buffer[0]&chapterWSFlag != 0, buffer[0]&noteLogValueMask
+	c.Second = buffer[1] & noteLogValueMask
+	return c, chapterWLen, nil
+}
+
+// pitchWheelState tracks the Pitch Wheel commands of a channel
+type pitchWheelState struct {
+	recorded bool
+	seqNum   uint32
+	first    uint8
+	second   uint8
+}
+
+func (w *pitchWheelState) record(seqNum uint32, p rtp.MIDIPayload) {
+	if p[0]&0xf0 != pitchWheel {
+		return
+	}
+	w.recorded = true
+	w.seqNum = seqNum
+	w.first, w.second = p[1]&0x7f, p[2]&0x7f
+}
+
+// chapter returns the Chapter W if the pitch wheel was changed since the checkpoint.
+func (w *pitchWheelState) chapter(checkpoint, seqNum uint32) *ChapterW {
+	if !w.recorded || seqNumBefore(w.seqNum, checkpoint) {
+		return nil
+	}
+	return &ChapterW{S: w.seqNum != seqNum-1, First: w.first, Second: w.second}
+}
@@ -0,0 +1,86 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterW(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterW{S: true, First: 0x01, Second: 0x40}
+	// when
+	c.encode(b)
+	actual, n, err := decodeChapterW(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x81, 0x40}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, c, actual)
+}
+
+func Test_pitchWheelState_keeps_the_last_value(t *testing.T) {
+	// given
+	w := pitchWheelState{}
+	w.record(1, []byte{0xe0, 0x00, 0x40})
+	w.record(2, []byte{0xe0, 0x10, 0x50})
+	w.record(2, []byte{0x90, 0x3c, 0x40})
+	// when
+	c := w.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterW{First: 0x10, Second: 0x50}, c)
+}
+
+func Test_pitchWheelState_sets_S_bit_for_older_commands(t *testing.T) {
+	// given
+	w := pitchWheelState{}
+	w.record(1, []byte{0xe0, 0x10, 0x50})
+	// when
+	c := w.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterW{S: true, First: 0x10, Second: 0x50}, c)
+}
+
+func Test_pitchWheelState_omits_commands_before_checkpoint(t *testing.T) {
+	// given
+	empty := pitchWheelState{}
+	w := pitchWheelState{}
+	w.record(1, []byte{0xe0, 0x10, 0x50})
+	// when
+	c := w.chapter(2, 3)
+	// then
+	assert.Nil(t, c)
+	assert.Nil(t, empty.chapter(1, 3))
+}
+
+func Test_receiver_restores_pitch_wheel(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xe2, 0x00, 0x40}), s))
+	withJournal(message(2, now, []byte{0xe2, 0x7f, 0x7f}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0xe2, 0x7f, 0x7f}}}, repair)
+}
+
+func Test_receiver_keeps_known_pitch_wheel(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xe2, 0x00, 0x40}), s))
+	withJournal(message(2, now, []byte{0xe2, 0x00, 0x40}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Empty(t, repair)
+}
@@ -0,0 +1,175 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|T|C|F|D|L|STA|    TCOUNT     |     COUNT     |  FIRST ...    |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |  DATA ...                                                     |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+    Figure B.5.1 -- Chapter X log format
+
+   Chapter X is a list of logs which fills the rest of the system journal.
+   The last octet of the FIRST and DATA fields has its most significant bit set.
+
+*/
+
+const (
+	sysExLogSFlag = 0x80
+	sysExLogTFlag = 0x40 // TCOUNT present
+	sysExLogCFlag = 0x20 // COUNT present
+	sysExLogFFlag = 0x10 // FIRST present
+	sysExLogDFlag = 0x08 // DATA present
+	sysExLogLFlag = 0x04 // list of commands
+
+	// maxSysExLogs limits the number of SysEx commands tracked in a stream.
+	maxSysExLogs = 128
+	// maxChapterXLength limits the size of Chapter X within the system journal.
+	maxChapterXLength = 768
+)
+
+// ChapterX is responsible for MIDI System Exclusive (0xF0) commands
+type ChapterX struct {
+	Logs []SysExLog
+}
+
+// SysExLog contains a System Exclusive command.
+type SysExLog struct {
+	S bool
+	// Data contains the octets between the 0xF0 and 0xF7 of the command.
+	Data []byte
+}
+
+func (c ChapterX) encode(b *bytes.Buffer) {
+	for _, l := range c.Logs {
+		b.WriteByte(flag(l.S, sysExLogSFlag) | flag(len(l.Data) > 0, sysExLogDFlag))
+		for i, d := range l.Data {
+			b.WriteByte(flag(i == len(l.Data)-1, systemLogMSBFlag) | d&systemDataMask)
+		}
+	}
+}
+
+func (l SysExLog) length() int {
+	return 1 + len(l.Data)
+}
+
+func decodeChapterX(buffer []byte) (c ChapterX, err error) {
+	n := 0
+	for n < len(buffer) {
+		header := buffer[n]
+		l := SysExLog{S: header&sysExLogSFlag != 0}
+		n++
+		if header&sysExLogTFlag != 0 {
+			n++
+		}
+		if header&sysExLogCFlag != 0 {
+			n++
+		}
+		if header&sysExLogFFlag != 0 {
+			for n < len(buffer) && buffer[n]&systemLogMSBFlag == 0 {
+				n++
+			}
+			n++
+		}
+		if header&sysExLogDFlag != 0 {
+			for ; n < len(buffer); n++ {
+				l.Data = append(l.Data, buffer[n]&systemDataMask)
+				if buffer[n]&systemLogMSBFlag != 0 {
+					break
+				}
+			}
+			if n == len(buffer) {
+				return c, fmt.Errorf("%w: chapter X data", ErrTruncated)
+			}
+			n++
+		}
+		if n > len(buffer) {
+			return c, fmt.Errorf("%w: chapter X log", ErrTruncated)
+		}
+		c.Logs = append(c.Logs, l)
+	}
+	return
+}
+
+// sysExState tracks the System Exclusive commands of a stream. Every distinct
+// command is only tracked with its most recent occurrence.
+type sysExState struct {
+	logs []sysExLog
+}
+
+type sysExLog struct {
+	seqNum uint32
+	data   []byte
+}
+
+func (x *sysExState) record(seqNum uint32, p rtp.MIDIPayload) {
+	if p[0] != sysExStart || p[len(p)-1] != sysExEnd || isFullFrame(p) {
+		return
+	}
+	data := append([]byte{}, p[1:len(p)-1]...)
+	x.remove(data)
+	x.logs = append(x.logs, sysExLog{seqNum: seqNum, data: data})
+	if len(x.logs) > maxSysExLogs {
+		x.logs = x.logs[len(x.logs)-maxSysExLogs:]
+	}
+}
+
+func (x *sysExState) remove(data []byte) {
+	for i, l := range x.logs {
+		if bytes.Equal(l.data, data) {
+			x.logs = append(x.logs[:i], x.logs[i+1:]...)
+			return
+		}
+	}
+}
+
+// contains returns true if the command was tracked.
+func (x *sysExState) contains(data []byte) bool {
+	for _, l := range x.logs {
+		if bytes.Equal(l.data, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// trim removes the commands sent before the checkpoint.
+func (x *sysExState) trim(checkpoint uint32) {
+	for len(x.logs) > 0 && seqNumBefore(x.logs[0].seqNum, checkpoint) {
+		x.logs = x.logs[1:]
+	}
+}
+
+// chapter returns the Chapter X for the commands sent since the checkpoint
+// or nil if no SysEx was sent since. The most recent commands are kept if
+// the chapter would exceed its size limit.
+func (x *sysExState) chapter(checkpoint, seqNum uint32) *ChapterX {
+	c := ChapterX{}
+	length := 0
+	for i := len(x.logs) - 1; i >= 0; i-- {
+		l := x.logs[i]
+		if seqNumBefore(l.seqNum, checkpoint) {
+			break
+		}
+		log := SysExLog{S: l.seqNum != seqNum-1, Data: l.data}
+		if length+log.length() > maxChapterXLength {
+			break
+		}
+		length += log.length()
+		c.Logs = append([]SysExLog{log}, c.Logs...)
+	}
+	if len(c.Logs) == 0 {
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,55 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_codec_of_chapterX(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	c := ChapterX{Logs: []SysExLog{
+		{S: true, Data: []byte{0x7e, 0x00, 0x09, 0x01}},
+		{Data: []byte{0x43}},
+	}}
+	// when
+	c.encode(b)
+	actual, err := decodeChapterX(b.Bytes())
+	// then
+	assert.Equal(t, []byte{0x88, 0x7e, 0x00, 0x09, 0x81, 0x08, 0xc3}, b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, c, actual)
+}
+
+func Test_sysExState_keeps_most_recent_commands(t *testing.T) {
+	// given
+	x := sysExState{}
+	x.record(1, []byte{0xf0, 0x01, 0xf7})
+	x.record(1, []byte{0xf0, 0x02, 0xf7})
+	x.record(2, []byte{0xf0, 0x01, 0xf7})
+	// when
+	c := x.chapter(1, 3)
+	// then
+	assert.Equal(t, &ChapterX{Logs: []SysExLog{
+		{S: true, Data: []byte{0x02}},
+		{Data: []byte{0x01}},
+	}}, c)
+}
+
+func Test_receiver_restores_sysex(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0xf0, 0x7e, 0x00, 0x09, 0x01, 0xf7}), s))
+	withJournal(message(2, now, []byte{0xf0, 0x43, 0x10, 0xf7}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0xf0, 0x43, 0x10, 0xf7}}}, repair)
+}
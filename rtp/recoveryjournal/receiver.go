@@ -0,0 +1,342 @@
+package recoveryjournal
+
+import (
+	"bytes"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+// Receiver keeps track of the MIDI commands received in a stream. When a packet
+// loss is detected, the recovery journal of the next received message is used
+// to synthesize the commands which repair the state.
+type Receiver struct {
+	started  bool
+	seqNum   uint32 // extended sequence number of the last received message
+	system   systemState
+	channels [16]receivedChannel
+}
+
+// receivedChannel contains the state of a single MIDI channel at the receiver.
+type receivedChannel struct {
+	notes           [128]bool
+	controllers     [128]receivedController
+	program         receivedController
+	pitchWheel      [2]uint8
+	pitchKnown      bool
+	channelPressure receivedController
+	pressure        [128]receivedController
+	selection       parameterSelection
+	parameters      map[parameterNumber]receivedParameter
+}
+
+type receivedParameter struct {
+	entryMSB receivedController
+	entryLSB receivedController
+	buttons  int16
+}
+
+type receivedController struct {
+	known   bool
+	value   uint8
+	toggles uint8 // on/off toggles of a switch controller
+}
+
+// NewReceiver creates a Receiver without any received message.
+func NewReceiver() *Receiver {
+	return &Receiver{}
+}
+
+// Receive processes a received message. After a packet loss, the recovery journal
+// of the message is decoded and the commands which repair the state are returned.
+// The repair commands have to be executed before the commands of the message.
+func (r *Receiver) Receive(msg rtp.MIDIMessage) (repair []rtp.MIDICommand, err error) {
+	seqNum := uint32(msg.SequenceNumber)
+	if r.started {
+		seqNum = r.extend(msg.SequenceNumber)
+	}
+	loss := r.started && seqNumBefore(r.seqNum+1, seqNum)
+	if !r.started || seqNumBefore(r.seqNum, seqNum) {
+		r.started = true
+		r.seqNum = seqNum
+	}
+
+	if loss && len(msg.Journal) > 0 {
+		j, dErr := Decode(msg.Journal)
+		if dErr != nil {
+			err = dErr
+		} else {
+			repair = r.repair(j, r.extend(uint16(j.CheckpointPackageSeqNum)))
+		}
+	}
+
+	for _, mc := range msg.Commands.Commands {
+		r.record(mc.Payload)
+	}
+	return
+}
+
+// extend returns the extended sequence number closest to the last received one.
+func (r *Receiver) extend(seqNum uint16) uint32 {
+	return r.seqNum + uint32(int32(int16(seqNum-uint16(r.seqNum))))
+}
+
+// repair returns the commands which bring the receiver into the state of the journal.
+// The state is updated with every repair command immediately.
+func (r *Receiver) repair(j RecoveryJournal, checkpoint uint32) (repair []rtp.MIDICommand) {
+	command := func(payload ...byte) rtp.MIDICommand {
+		r.record(payload)
+		return rtp.MIDICommand{Payload: payload}
+	}
+	if j.SystemJournal != nil {
+		repair = append(repair, r.repairSystem(j.SystemJournal, checkpoint, command)...)
+	}
+	for channel := uint8(0); channel < 16; channel++ {
+		chapters, found := j.ChannelJournal.Channels[channel]
+		if !found {
+			continue
+		}
+		state := &r.channels[channel]
+		if p := chapters.ChapterP; p != nil && (!state.program.known || state.program.value != p.Program) {
+			if p.B && !p.X {
+				repair = append(repair,
+					command(controlChange|channel, bankSelectMSB, p.BankMSB),
+					command(controlChange|channel, bankSelectLSB, p.BankLSB))
+			}
+			repair = append(repair, command(programChange|channel, p.Program))
+		}
+		if c := chapters.ChapterC; c != nil {
+			// replay the missed toggles first, the value logs restore the final value
+			for _, l := range c.Logs {
+				if l.Tool != ToggleTool || !switchController(l.Number) {
+					continue
+				}
+				for missed := (l.Value - state.controllers[l.Number].toggles) & controllerAlt; missed > 0; missed-- {
+					value := uint8(0x7f)
+					if switchOn(state.controllers[l.Number].value) {
+						value = 0x00
+					}
+					repair = append(repair, command(controlChange|channel, l.Number, value))
+				}
+			}
+			for _, l := range c.Logs {
+				controller := state.controllers[l.Number]
+				if l.Tool == ValueTool && !modeController(l.Number) && (!controller.known || controller.value != l.Value) {
+					repair = append(repair, command(controlChange|channel, l.Number, l.Value))
+				}
+			}
+		}
+		if m := chapters.ChapterM; m != nil {
+			repair = append(repair, state.repairParameters(m, channel, command)...)
+		}
+		if w := chapters.ChapterW; w != nil && (!state.pitchKnown || state.pitchWheel != [2]uint8{w.First, w.Second}) {
+			repair = append(repair, command(pitchWheel|channel, w.First, w.Second))
+		}
+		if n := chapters.ChapterN; n != nil {
+			velocities := [128]uint8{}
+			if e := chapters.ChapterE; e != nil {
+				for _, l := range e.Logs {
+					if l.V {
+						velocities[l.NoteNum] = l.Value
+					}
+				}
+			}
+			for _, off := range n.NoteOff {
+				if state.notes[off.NoteNum] {
+					repair = append(repair, command(noteOff|channel, off.NoteNum, velocities[off.NoteNum]))
+				}
+			}
+			for _, on := range n.NoteOn {
+				if !state.notes[on.NoteNum] && on.PlayRecommendation {
+					repair = append(repair, command(noteOn|channel, on.NoteNum, on.Velocity))
+				}
+			}
+		}
+		if t := chapters.ChapterT; t != nil && (!state.channelPressure.known || state.channelPressure.value != t.Pressure) {
+			repair = append(repair, command(channelAftertouch|channel, t.Pressure))
+		}
+		if a := chapters.ChapterA; a != nil {
+			for _, l := range a.Logs {
+				pressure := state.pressure[l.NoteNum]
+				if !l.X && state.notes[l.NoteNum] && (!pressure.known || pressure.value != l.Pressure) {
+					repair = append(repair, command(polyAftertouch|channel, l.NoteNum, l.Pressure))
+				}
+			}
+		}
+	}
+	return
+}
+
+// repairSystem restores the system commands of the system journal which differ
+// from the received state.
+func (r *Receiver) repairSystem(j *SystemJournal, checkpoint uint32, command func(...byte) rtp.MIDICommand) (repair []rtp.MIDICommand) {
+	state := &r.system
+	if d := j.ChapterD; d != nil {
+		if d.Reset != nil && d.Reset.Value != state.commands.reset.count&systemDataMask {
+			repair = append(repair, command(systemReset))
+			state.commands.reset.count = d.Reset.Value
+		}
+		if d.TuneRequest != nil && d.TuneRequest.Value != state.commands.tuneRequest.count&systemDataMask {
+			repair = append(repair, command(tuneRequest))
+			state.commands.tuneRequest.count = d.TuneRequest.Value
+		}
+		if d.SongSelect != nil && (!state.commands.songSelect.recorded || state.commands.songSelect.value != d.SongSelect.Value) {
+			repair = append(repair, command(songSelect, d.SongSelect.Value))
+		}
+	}
+	if q := j.ChapterQ; q != nil {
+		if q.HasClock && (!state.sequencer.recorded || state.sequencer.position != q.Clock) {
+			beats := q.Clock / clocksPerBeat
+			repair = append(repair, command(songPosition, byte(beats)&systemDataMask, byte(beats>>7)&systemDataMask))
+			state.sequencer.position = q.Clock
+		}
+		if q.N != state.sequencer.running {
+			if q.N {
+				repair = append(repair, command(sequencerResume))
+			} else {
+				repair = append(repair, command(sequencerStop))
+			}
+		}
+	}
+	if f := j.ChapterF; f != nil && f.HasComplete {
+		received := ChapterF{Q: state.timeCode.quarter, Complete: state.timeCode.complete}
+		if !state.timeCode.hasComplete || !bytes.Equal(received.fullFrame(), f.fullFrame()) {
+			repair = append(repair, command(fullFrameMessage(f.fullFrame())...))
+		}
+	}
+	if x := j.ChapterX; x != nil {
+		state.sysEx.trim(checkpoint)
+		for _, l := range x.Logs {
+			if !state.sysEx.contains(l.Data) {
+				repair = append(repair, command(append(append([]byte{sysExStart}, l.Data...), sysExEnd)...))
+			}
+		}
+	}
+	return
+}
+
+// record updates the received state with the command if it is journaled.
+func (r *Receiver) record(p rtp.MIDIPayload) {
+	if !journaled(p) {
+		return
+	}
+	if p[0] >= sysExStart {
+		r.system.record(r.seqNum, p)
+		return
+	}
+	state := &r.channels[p[0]&0x0f]
+	switch p[0] & 0xf0 {
+	case noteOff:
+		state.notes[p[1]&0x7f] = false
+	case noteOn:
+		state.notes[p[1]&0x7f] = p[2] > 0
+	case polyAftertouch:
+		state.pressure[p[1]&0x7f] = receivedController{known: true, value: p[2] & 0x7f}
+	case channelAftertouch:
+		state.channelPressure = receivedController{known: true, value: p[1] & 0x7f}
+	case programChange:
+		state.program = receivedController{known: true, value: p[1] & 0x7f}
+	case pitchWheel:
+		state.pitchKnown = true
+		state.pitchWheel = [2]uint8{p[1] & 0x7f, p[2] & 0x7f}
+	case controlChange:
+		controller := &state.controllers[p[1]&0x7f]
+		if switchOn(controller.value) != switchOn(p[2]&0x7f) {
+			controller.toggles++
+		}
+		controller.known, controller.value = true, p[2]&0x7f
+		state.recordParameter(p[1]&0x7f, p[2]&0x7f)
+		if p[1] == allSoundOff || p[1] >= allNotesOff {
+			state.notes = [128]bool{}
+		}
+	}
+}
+
+func (state *receivedChannel) recordParameter(number, value uint8) {
+	if !parameterController(number) {
+		return
+	}
+	switch number {
+	case nrpnLSB, nrpnMSB, rpnLSB, rpnMSB:
+		state.selection.update(number, value)
+		return
+	}
+	if !state.selection.selected {
+		return
+	}
+	if state.parameters == nil {
+		state.parameters = map[parameterNumber]receivedParameter{}
+	}
+	p := state.parameters[state.selection.number()]
+	switch number {
+	case dataEntryMSB:
+		p = receivedParameter{entryMSB: receivedController{known: true, value: value}}
+	case dataEntryLSB:
+		p.entryLSB, p.buttons = receivedController{known: true, value: value}, 0
+	case dataIncrement:
+		p.buttons++
+	case dataDecrement:
+		p.buttons--
+	}
+	state.parameters[state.selection.number()] = p
+}
+
+// repairParameters restores the parameters of the Chapter M logs which differ from
+// the received state and finally restores the parameter selection.
+func (state *receivedChannel) repairParameters(m *ChapterM, channel uint8, command func(...byte) rtp.MIDICommand) (repair []rtp.MIDICommand) {
+	selectParameter := func(nrpn bool, msb, lsb uint8) {
+		if nrpn {
+			repair = append(repair, command(controlChange|channel, nrpnMSB, msb), command(controlChange|channel, nrpnLSB, lsb))
+		} else {
+			repair = append(repair, command(controlChange|channel, rpnMSB, msb), command(controlChange|channel, rpnLSB, lsb))
+		}
+	}
+	for _, l := range m.Logs {
+		p := state.parameters[parameterNumber{nrpn: l.NRPN, msb: l.NumberMSB, lsb: l.NumberLSB}]
+		entryMSB := l.HasEntryMSB && (!p.entryMSB.known || p.entryMSB.value != l.EntryMSB)
+		entryLSB := l.HasEntryLSB && (!p.entryLSB.known || p.entryLSB.value != l.EntryLSB)
+		buttons := l.Buttons - p.buttons
+		if entryMSB || entryLSB {
+			buttons = l.Buttons
+		}
+		if !entryMSB && !entryLSB && buttons == 0 {
+			continue
+		}
+		selectParameter(l.NRPN, l.NumberMSB, l.NumberLSB)
+		if entryMSB || entryLSB {
+			if l.HasEntryMSB {
+				repair = append(repair, command(controlChange|channel, dataEntryMSB, l.EntryMSB))
+			}
+			if l.HasEntryLSB {
+				repair = append(repair, command(controlChange|channel, dataEntryLSB, l.EntryLSB))
+			}
+		}
+		for ; buttons > 0; buttons-- {
+			repair = append(repair, command(controlChange|channel, dataIncrement, 0))
+		}
+		for ; buttons < 0; buttons++ {
+			repair = append(repair, command(controlChange|channel, dataDecrement, 0))
+		}
+	}
+
+	switch {
+	case m.E:
+		if !state.selection.selected || !state.selection.number().null() {
+			selectParameter(false, nullFunction, nullFunction)
+		}
+	case m.Pending:
+		if state.selection.nrpn != m.PendingNRPN || state.selection.lsbSet || state.selection.msb != m.PendingMSB {
+			number := byte(rpnMSB)
+			if m.PendingNRPN {
+				number = nrpnMSB
+			}
+			state.selection = parameterSelection{}
+			repair = append(repair, command(controlChange|channel, number, m.PendingMSB))
+		}
+	case len(m.Logs) > 0:
+		last := m.Logs[len(m.Logs)-1]
+		if !state.selection.selected || state.selection.number() != (parameterNumber{nrpn: last.NRPN, msb: last.NumberMSB, lsb: last.NumberLSB}) {
+			selectParameter(last.NRPN, last.NumberMSB, last.NumberLSB)
+		}
+	}
+	return
+}
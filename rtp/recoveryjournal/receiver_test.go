@@ -0,0 +1,116 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func withJournal(msg rtp.MIDIMessage, s *Sender) rtp.MIDIMessage {
+	b := new(bytes.Buffer)
+	j := s.Journal(msg)
+	j.Encode(b)
+	msg.Journal = b.Bytes()
+	s.Record(msg)
+	return msg
+}
+
+func Test_decode_of_encoded_journal(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(1, now, []byte{0x90, 0x3c, 0x40}, []byte{0x92, 0x3e, 0x40}))
+	s.Record(message(2, now, []byte{0x80, 0x3c, 0x00}))
+	expected := s.Journal(message(3, now))
+	b := new(bytes.Buffer)
+	expected.Encode(b)
+	// when
+	actual, err := Decode(b.Bytes())
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func Test_decode_of_encoded_system_journal(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(1, now, []byte{0xfa}, []byte{0xf0, 0x01, 0xf7}, []byte{0xfe}))
+	s.Record(message(2, now, []byte{0xf3, 0x02}, []byte{0xf1, 0x13}, []byte{0x90, 0x3c, 0x40}))
+	expected := s.Journal(message(3, now))
+	b := new(bytes.Buffer)
+	expected.Encode(b)
+	// when
+	actual, err := Decode(b.Bytes())
+	// then
+	assert.Nil(t, err)
+	assert.NotNil(t, actual.SystemJournal)
+	assert.Equal(t, expected, actual)
+}
+
+func Test_decode_of_truncated_journal(t *testing.T) {
+	// when
+	_, header := Decode([]byte{0x20, 0x00})
+	_, channel := Decode([]byte{0x20, 0x00, 0x01, 0x00, 0x07, 0x08, 0x81})
+	// then
+	assert.True(t, errors.Is(header, ErrTruncated))
+	assert.True(t, errors.Is(channel, ErrTruncated))
+}
+
+func Test_receiver_repairs_stuck_note(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0x90, 0x3c, 0x40}), s))
+	withJournal(message(2, now, []byte{0x80, 0x3c, 0x00}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0x80, 0x3c, 0x00}}}, repair)
+}
+
+func Test_receiver_plays_recent_note(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now), s))
+	withJournal(message(2, now, []byte{0x91, 0x3c, 0x40}), s) // lost
+	// when
+	repair, err := r.Receive(withJournal(message(3, now.Add(time.Millisecond)), s))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0x91, 0x3c, 0x40}}}, repair)
+}
+
+func Test_receiver_without_loss_does_not_repair(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	r := NewReceiver()
+	r.Receive(withJournal(message(1, now, []byte{0x90, 0x3c, 0x40}), s))
+	// when
+	repair, err := r.Receive(withJournal(message(2, now, []byte{0x80, 0x3c, 0x00}), s))
+	// then
+	assert.Nil(t, err)
+	assert.Empty(t, repair)
+}
+
+func Test_receiver_does_not_record_commands_rejected_by_parse(t *testing.T) {
+	// given
+	r := NewReceiver()
+	// when
+	r.record([]byte{0x90, 0x3c, 0x80})
+	r.record([]byte{0xf7, 0x01, 0xf7})
+	r.record([]byte{0x90, 0x3e, 0x40})
+	// then
+	assert.False(t, r.channels[0].notes[0x3c])
+	assert.True(t, r.channels[0].notes[0x3e])
+	assert.Empty(t, r.system.sysEx.logs)
+}
@@ -1,11 +1,16 @@
 package recoveryjournal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
 	"github.com/laenzlinger/go-midi-rtp/rtp"
 )
 
 // CheckpointHistory contains the history of sent packets of a stream
-// since the start of the checkopoint.
+// since the start of the checkopoint. At most the last 64 packets are kept.
 type CheckpointHistory struct {
 	SentMessages []rtp.MIDIMessage
 }
@@ -13,26 +18,32 @@ type CheckpointHistory struct {
 // RecoveryJournal contains the internal structure of the complete
 // sender recovery journal
 type RecoveryJournal struct {
+	// SinglePacketLoss is false if the journal contains commands of the previous packet.
+	SinglePacketLoss bool
+
+	// EnhancedChapterC is true if the channel journals use the enhanced Chapter C encoding.
+	EnhancedChapterC bool
+
 	// SequNum contains the extended sequence number, or 0.
 	// SequNum = 0 codes empty journal
+	// A decoded journal contains only the lower 16 bits.
 	CheckpointPackageSeqNum uint32
 
+	// SystemJournal contains the system part of the history, or nil.
+	SystemJournal *SystemJournal
+
 	// ChannelJournal contains the channel part of the history
 	ChannelJournal ChannelJournal
-
-	// TODO add system journal
 }
 
 /*
+	   0                   1                   2
+	   0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
+	  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	  |S|Y|A|H|TOTCHAN|   Checkpoint Packet Seqnum    |
+	  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
-   0                   1                   2
-   0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
-  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-  |S|Y|A|H|TOTCHAN|   Checkpoint Packet Seqnum    |
-  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-
-		Figure 8 -- Recovery Journal Header
-
+			Figure 8 -- Recovery Journal Header
 */
 const (
 	headerSFlag = 0x80 // Single Package Loss
@@ -43,6 +54,66 @@ const (
 )
 
 // Encode will write the recovery journal to a package
-func (j *RecoveryJournal) Encode() {
+func (j *RecoveryJournal) Encode(b *bytes.Buffer) error {
+	header := byte(0)
+	if j.SinglePacketLoss {
+		header |= headerSFlag
+	}
+	if j.EnhancedChapterC {
+		header |= headerHFlag
+	}
+	if j.SystemJournal != nil {
+		header |= headerYFlag
+	}
+	channels := len(j.ChannelJournal.Channels)
+	if channels > totChanMask+1 {
+		return fmt.Errorf("too many channel journals: %d", channels)
+	}
+	if channels > 0 {
+		header |= headerAFlag | byte(channels-1)&totChanMask
+	}
+	b.WriteByte(header)
+	binary.Write(b, binary.BigEndian, uint16(j.CheckpointPackageSeqNum))
+
+	if j.SystemJournal != nil {
+		if err := j.SystemJournal.encode(b); err != nil {
+			return err
+		}
+	}
+	return j.ChannelJournal.Encode(b)
+}
+
+// ErrTruncated is returned when the journal is shorter than its length fields.
+var ErrTruncated = errors.New("truncated recovery journal")
+
+// systemLengthMask is the LENGTH field of the system journal header
+const systemLengthMask = 0x03ff
+
+// Decode a recovery journal section of a received message.
+func Decode(buffer []byte) (j RecoveryJournal, err error) {
+	if len(buffer) < 3 {
+		err = fmt.Errorf("%w: header", ErrTruncated)
+		return
+	}
+	header := buffer[0]
+	j.SinglePacketLoss = header&headerSFlag != 0
+	j.EnhancedChapterC = header&headerHFlag != 0
+	j.CheckpointPackageSeqNum = uint32(binary.BigEndian.Uint16(buffer[1:3]))
+	offset := 3
+
+	if header&headerYFlag != 0 {
+		system, n, sErr := decodeSystemJournal(buffer[offset:])
+		if sErr != nil {
+			err = sErr
+			return
+		}
+		j.SystemJournal = &system
+		offset += n
+	}
 
+	if header&headerAFlag != 0 {
+		channels := int(header&totChanMask) + 1
+		j.ChannelJournal, err = decodeChannelJournal(buffer[offset:], channels)
+	}
+	return
 }
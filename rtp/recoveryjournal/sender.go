@@ -0,0 +1,150 @@
+package recoveryjournal
+
+import (
+	"github.com/laenzlinger/go-midi-rtp/midi"
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+// Sender keeps track of the MIDI commands sent in a stream and creates the
+// recovery journal which is appended to the next message.
+//
+// The Sender implements the closed-loop sending policy: the journal covers all
+// messages sent since the checkpoint, which is moved forward every time the
+// receiver acknowledges a sequence number.
+type Sender struct {
+	History CheckpointHistory
+	// EnhancedChapterC enables the enhanced Chapter C encoding.
+	EnhancedChapterC bool
+	started          bool
+	checkpoint       uint32 // extended sequence number of the checkpoint packet
+	seqNum           uint32 // extended sequence number of the last recorded packet
+	system           systemState
+	channels         [16]*channelState
+}
+
+// maxSentMessages limits the history when the receiver does not acknowledge the
+// messages. The journal itself does not depend on the history.
+const maxSentMessages = 64
+
+// NewSender creates a Sender with an empty journal.
+func NewSender() *Sender {
+	return &Sender{}
+}
+
+// Record adds the commands of a sent message to the journal state.
+// Only the commands accepted by journaled are recorded.
+func (s *Sender) Record(msg rtp.MIDIMessage) {
+	seqNum := s.extend(msg.SequenceNumber)
+	if !s.started {
+		s.started = true
+		s.checkpoint = seqNum
+	}
+	s.seqNum = seqNum
+	s.History.SentMessages = append(s.History.SentMessages, msg)
+	if len(s.History.SentMessages) > maxSentMessages {
+		s.History.SentMessages = s.History.SentMessages[len(s.History.SentMessages)-maxSentMessages:]
+	}
+
+	times := msg.Commands.Times()
+	for i, mc := range msg.Commands.Commands {
+		p := mc.Payload
+		if !journaled(p) {
+			continue
+		}
+		if p[0] >= sysExStart {
+			s.system.record(seqNum, p)
+			continue
+		}
+		channel := p[0] & 0x0f
+		if s.channels[channel] == nil {
+			s.channels[channel] = &channelState{}
+		}
+		s.channels[channel].record(seqNum, times[i], p)
+	}
+}
+
+// Journal returns the recovery journal of the given message which is about to be sent.
+// The journal covers all messages recorded since the checkpoint.
+func (s *Sender) Journal(msg rtp.MIDIMessage) RecoveryJournal {
+	seqNum := s.extend(msg.SequenceNumber)
+	j := RecoveryJournal{
+		SinglePacketLoss:        true,
+		EnhancedChapterC:        s.EnhancedChapterC,
+		CheckpointPackageSeqNum: s.checkpoint,
+		ChannelJournal:          ChannelJournal{Channels: map[uint8]Chapters{}},
+	}
+	if !s.started {
+		j.CheckpointPackageSeqNum = seqNum
+		return j
+	}
+	if j.SystemJournal = s.system.journal(s.checkpoint, seqNum); j.SystemJournal != nil {
+		j.SinglePacketLoss = j.SystemJournal.SinglePacketLoss
+	}
+	for channel, state := range s.channels {
+		if state == nil {
+			continue
+		}
+		chapters, found := state.chapters(s.checkpoint, seqNum, msg.Commands.Timestamp, s.EnhancedChapterC)
+		if found {
+			j.ChannelJournal.Channels[uint8(channel)] = chapters
+			j.SinglePacketLoss = j.SinglePacketLoss && chapters.SinglePacketLoss
+		}
+	}
+	return j
+}
+
+// Acknowledge moves the checkpoint after the message with the given sequence number
+// which was reported by the receiver. The history up to this message is removed
+// from the journal.
+func (s *Sender) Acknowledge(seqNum uint16) {
+	if !s.started {
+		return
+	}
+	acknowledged := s.extend(seqNum)
+	if seqNumBefore(acknowledged, s.checkpoint) || seqNumBefore(s.seqNum, acknowledged) {
+		return
+	}
+	s.checkpoint = acknowledged + 1
+	s.system.sysEx.trim(s.checkpoint)
+
+	sent := s.History.SentMessages
+	for len(sent) > 0 && !seqNumBefore(acknowledged, s.extendFrom(sent[0].SequenceNumber, s.checkpoint)) {
+		sent = sent[1:]
+	}
+	s.History.SentMessages = sent
+}
+
+// Checkpoint returns the extended sequence number of the checkpoint packet.
+func (s *Sender) Checkpoint() uint32 {
+	return s.checkpoint
+}
+
+// extend returns the extended sequence number closest to the last recorded one.
+func (s *Sender) extend(seqNum uint16) uint32 {
+	if !s.started {
+		return uint32(seqNum)
+	}
+	return s.extendFrom(seqNum, s.seqNum)
+}
+
+func (s *Sender) extendFrom(seqNum uint16, reference uint32) uint32 {
+	return reference + uint32(int32(int16(seqNum-uint16(reference))))
+}
+
+// journaled returns true if the command is tracked by the journal. The sender and
+// the receiver share the validation of midi.Parse, the following commands are
+// therefore not tracked:
+//
+//   - SysEx segments, see rtp.MIDIPayload.Segment. Only complete SysEx commands
+//     are coded in Chapter X.
+//   - Commands with a data octet above 0x7f or with a wrong length.
+//   - Commands without a status octet.
+func journaled(p rtp.MIDIPayload) bool {
+	_, err := midi.Parse(p)
+	return err == nil
+}
+
+// seqNumBefore returns true if the extended sequence number a is before b.
+func seqNumBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,148 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func message(seqNum uint16, t time.Time, payloads ...rtp.MIDIPayload) rtp.MIDIMessage {
+	mcs := rtp.MIDICommands{Timestamp: t}
+	for _, p := range payloads {
+		mcs.Commands = append(mcs.Commands, rtp.MIDICommand{Payload: p})
+	}
+	return rtp.MIDIMessage{SequenceNumber: seqNum, Commands: mcs}
+}
+
+func Test_empty_journal(t *testing.T) {
+	// given
+	s := NewSender()
+	b := new(bytes.Buffer)
+	// when
+	j := s.Journal(message(0x1234, time.Now()))
+	err := j.Encode(b)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x80, 0x12, 0x34}, b.Bytes())
+}
+
+func Test_journal_with_chapterN(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(0xffff, now, []byte{0x96, 0x3c, 0x40}))
+	b := new(bytes.Buffer)
+	// when
+	j := s.Journal(message(0x0000, now.Add(time.Second)))
+	err := j.Encode(b)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0x20, 0xff, 0xff, // Recovery journal header (A, TOTCHAN=0, checkpoint)
+		0x30, 0x07, 0x08, // Channel journal header (CHAN=6, LENGTH=7, TOC=N)
+		0x81, 0xf1, // Chapter N header
+		0x3c, 0x40, // NoteOn log (S=0, Y=0)
+	}, b.Bytes())
+}
+
+func Test_journal_sets_single_packet_loss_for_older_commands(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(1, now, []byte{0x90, 0x3c, 0x40}))
+	s.Record(message(2, now, []byte{0x91, 0x3c, 0x40}))
+	// when
+	j := s.Journal(message(3, now))
+	// then
+	assert.False(t, j.SinglePacketLoss)
+	assert.True(t, j.ChannelJournal.Channels[0].SinglePacketLoss)
+	assert.False(t, j.ChannelJournal.Channels[1].SinglePacketLoss)
+	assert.Equal(t, uint32(1), j.CheckpointPackageSeqNum)
+}
+
+func Test_acknowledge_moves_checkpoint(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(1, now, []byte{0x90, 0x3c, 0x40}))
+	s.Record(message(2, now, []byte{0x90, 0x3e, 0x40}))
+	s.Record(message(3, now, []byte{0x90, 0x40, 0x40}))
+	// when
+	s.Acknowledge(2)
+	j := s.Journal(message(4, now))
+	// then
+	assert.Equal(t, uint32(3), s.Checkpoint())
+	assert.Equal(t, uint32(3), j.CheckpointPackageSeqNum)
+	assert.Len(t, s.History.SentMessages, 1)
+	assert.Equal(t, uint16(3), s.History.SentMessages[0].SequenceNumber)
+	assert.Equal(t, []NoteOn{{NoteNum: 0x40, Velocity: 0x40, PlayRecommendation: true}},
+		j.ChannelJournal.Channels[0].ChapterN.NoteOn)
+}
+
+func Test_acknowledge_of_all_messages_empties_journal(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(0xfffe, now, []byte{0x90, 0x3c, 0x40}))
+	s.Record(message(0xffff, now, []byte{0x80, 0x3c, 0x40}))
+	// when
+	s.Acknowledge(0xffff)
+	j := s.Journal(message(0, now))
+	// then
+	assert.Empty(t, s.History.SentMessages)
+	assert.Empty(t, j.ChannelJournal.Channels)
+	assert.Equal(t, uint32(0x10000), j.CheckpointPackageSeqNum)
+}
+
+func Test_history_is_limited_without_acknowledge(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	// when
+	for i := 0; i < 1000; i++ {
+		s.Record(message(uint16(i), now, []byte{0x90, 0x3c, 0x40}))
+	}
+	// then
+	assert.Len(t, s.History.SentMessages, maxSentMessages)
+	assert.Equal(t, uint16(999), s.History.SentMessages[maxSentMessages-1].SequenceNumber)
+	assert.Equal(t, uint32(0), s.Checkpoint())
+}
+
+func Test_acknowledge_ignores_unknown_sequence_numbers(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(10, now, []byte{0x90, 0x3c, 0x40}))
+	s.Record(message(11, now, []byte{0x90, 0x3c, 0x40}))
+	s.Acknowledge(10)
+	// when
+	s.Acknowledge(9)
+	s.Acknowledge(12)
+	// then
+	assert.Equal(t, uint32(11), s.Checkpoint())
+	assert.Len(t, s.History.SentMessages, 1)
+}
+
+func Test_commands_rejected_by_parse_are_not_journaled(t *testing.T) {
+	// given
+	now := time.Now()
+	s := NewSender()
+	s.Record(message(1, now))
+	// when
+	s.Record(message(2, now,
+		[]byte{0xf0, 0x01, 0xf0}, // first SysEx segment
+		[]byte{0xf7, 0x02, 0xf7}, // last SysEx segment
+		[]byte{0x90, 0x3c, 0x80}, // data octet above 0x7f
+		[]byte{0xc0},             // wrong length
+		[]byte{0x3c, 0x40},       // no status
+	))
+	j := s.Journal(message(3, now))
+	// then
+	assert.Nil(t, j.SystemJournal)
+	assert.Empty(t, j.ChannelJournal.Channels)
+	assert.True(t, journaled([]byte{0xf0, 0x01, 0x02, 0xf7}))
+	assert.True(t, journaled([]byte{0x90, 0x3c, 0x7f}))
+}
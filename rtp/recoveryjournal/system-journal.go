@@ -0,0 +1,204 @@
+package recoveryjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+)
+
+// SystemJournal contains the chapters of the MIDI system commands.
+type SystemJournal struct {
+	// SinglePacketLoss is false if the chapters contain commands of the previous packet.
+	SinglePacketLoss bool
+	ChapterD         *ChapterD
+	ChapterV         *ChapterV
+	ChapterQ         *ChapterQ
+	ChapterF         *ChapterF
+	ChapterX         *ChapterX
+}
+
+/*
+
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+   |S|D|V|Q|F|X|      LENGTH       |  System chapters ...          |
+   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+                 Figure 10 -- System Journal Format
+
+*/
+
+const (
+	systemSFlag     = 0x8000 // Single Package Loss
+	systemDFlag     = 0x4000 // Chapter D present
+	systemVFlag     = 0x2000 // Chapter V present
+	systemQFlag     = 0x1000 // Chapter Q present
+	systemFFlag     = 0x0800 // Chapter F present
+	systemXFlag     = 0x0400 // Chapter X present
+	systemHeaderLen = 2
+)
+
+func (j SystemJournal) encode(b *bytes.Buffer) error {
+	header := uint16(0)
+	chapters := new(bytes.Buffer)
+	if j.SinglePacketLoss {
+		header |= systemSFlag
+	}
+	if j.ChapterD != nil {
+		header |= systemDFlag
+		j.ChapterD.encode(chapters)
+	}
+	if j.ChapterV != nil {
+		header |= systemVFlag
+		j.ChapterV.encode(chapters)
+	}
+	if j.ChapterQ != nil {
+		header |= systemQFlag
+		j.ChapterQ.encode(chapters)
+	}
+	if j.ChapterF != nil {
+		header |= systemFFlag
+		j.ChapterF.encode(chapters)
+	}
+	if j.ChapterX != nil {
+		header |= systemXFlag
+		j.ChapterX.encode(chapters)
+	}
+
+	length := systemHeaderLen + chapters.Len()
+	if length > systemLengthMask {
+		return fmt.Errorf("system journal is too long: %d octets", length)
+	}
+	binary.Write(b, binary.BigEndian, header|uint16(length))
+	b.Write(chapters.Bytes())
+	return nil
+}
+
+func decodeSystemJournal(buffer []byte) (j SystemJournal, n int, err error) {
+	if len(buffer) < systemHeaderLen {
+		return j, 0, fmt.Errorf("%w: system journal header", ErrTruncated)
+	}
+	header := binary.BigEndian.Uint16(buffer)
+	length := int(header & systemLengthMask)
+	if length < systemHeaderLen || len(buffer) < length {
+		return j, 0, fmt.Errorf("%w: system journal of %d octets", ErrTruncated, length)
+	}
+	j.SinglePacketLoss = header&systemSFlag != 0
+	buffer = buffer[:length]
+	offset := systemHeaderLen
+	if header&systemDFlag != 0 {
+		chapter, n, err := decodeChapterD(buffer[offset:])
+		if err != nil {
+			return j, 0, err
+		}
+		j.ChapterD = &chapter
+		offset += n
+	}
+	if header&systemVFlag != 0 {
+		chapter, n, err := decodeChapterV(buffer[offset:])
+		if err != nil {
+			return j, 0, err
+		}
+		j.ChapterV = &chapter
+		offset += n
+	}
+	if header&systemQFlag != 0 {
+		chapter, n, err := decodeChapterQ(buffer[offset:])
+		if err != nil {
+			return j, 0, err
+		}
+		j.ChapterQ = &chapter
+		offset += n
+	}
+	if header&systemFFlag != 0 {
+		chapter, n, err := decodeChapterF(buffer[offset:])
+		if err != nil {
+			return j, 0, err
+		}
+		j.ChapterF = &chapter
+		offset += n
+	}
+	if header&systemXFlag != 0 {
+		chapter, err := decodeChapterX(buffer[offset:])
+		if err != nil {
+			return j, 0, err
+		}
+		j.ChapterX = &chapter
+	}
+	return j, length, nil
+}
+
+// MIDI system commands
+const (
+	sysExStart       = 0xf0
+	timeCodeQuarter  = 0xf1
+	songPosition     = 0xf2
+	songSelect       = 0xf3
+	undefinedF4      = 0xf4
+	undefinedF5      = 0xf5
+	tuneRequest      = 0xf6
+	sysExEnd         = 0xf7
+	timingClock      = 0xf8
+	undefinedF9      = 0xf9
+	sequencerStart   = 0xfa
+	sequencerResume  = 0xfb
+	sequencerStop    = 0xfc
+	undefinedFD      = 0xfd
+	activeSense      = 0xfe
+	systemReset      = 0xff
+	systemDataMask   = 0x7f
+	systemLogMSBFlag = 0x80
+)
+
+// systemState tracks the system commands sent in a stream.
+type systemState struct {
+	commands    commandState
+	activeSense activeSenseState
+	sequencer   sequencerState
+	timeCode    timeCodeState
+	sysEx       sysExState
+}
+
+func (s *systemState) record(seqNum uint32, p rtp.MIDIPayload) {
+	s.commands.record(seqNum, p)
+	s.activeSense.record(seqNum, p)
+	s.sequencer.record(seqNum, p)
+	s.timeCode.record(seqNum, p)
+	s.sysEx.record(seqNum, p)
+}
+
+// journal returns the system journal for the commands sent since the checkpoint
+// or nil if no system command was sent since.
+func (s *systemState) journal(checkpoint, seqNum uint32) *SystemJournal {
+	j := SystemJournal{SinglePacketLoss: true}
+	found := false
+	if j.ChapterD = s.commands.chapter(checkpoint, seqNum); j.ChapterD != nil {
+		found = true
+		j.SinglePacketLoss = j.SinglePacketLoss && j.ChapterD.S
+	}
+	if j.ChapterV = s.activeSense.chapter(checkpoint, seqNum); j.ChapterV != nil {
+		found = true
+		j.SinglePacketLoss = j.SinglePacketLoss && j.ChapterV.S
+	}
+	if j.ChapterQ = s.sequencer.chapter(checkpoint, seqNum); j.ChapterQ != nil {
+		found = true
+		j.SinglePacketLoss = j.SinglePacketLoss && j.ChapterQ.S
+	}
+	if j.ChapterF = s.timeCode.chapter(checkpoint, seqNum); j.ChapterF != nil {
+		found = true
+		j.SinglePacketLoss = j.SinglePacketLoss && j.ChapterF.S
+	}
+	if j.ChapterX = s.sysEx.chapter(checkpoint, seqNum); j.ChapterX != nil {
+		found = true
+		for _, l := range j.ChapterX.Logs {
+			j.SinglePacketLoss = j.SinglePacketLoss && l.S
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &j
+}
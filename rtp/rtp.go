@@ -3,6 +3,7 @@ package rtp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -12,6 +13,7 @@ import (
 
 // Generic RTP constants
 const (
+	versionMask  = 0xc0
 	version2Bit  = 0x80
 	extensionBit = 0x10
 	paddingBit   = 0x20
@@ -69,12 +71,28 @@ type MIDIMessage struct {
 	SequenceNumber uint16
 	SSRC           uint32
 	Commands       MIDICommands
+	// Marker and PayloadType are only populated by Decode.
+	Marker      bool
+	PayloadType uint8
+	// Timestamp is the RTP timestamp of the received message. It is only
+	// populated by Decode, the sender uses Commands.Timestamp instead.
+	Timestamp uint32
+	// CSRC contains the contributing sources of the received message.
+	CSRC []uint32
+	// Journal contains the raw recovery journal section.
+	Journal []byte
 }
 
 // MIDICommands the list of MIDICommand sent inside a MIDIMessage
 type MIDICommands struct {
 	Timestamp time.Time
 	Commands  []MIDICommand
+	// RunningStatus omits the status octet of a channel voice command which has the
+	// same status as the previous channel voice command in the list.
+	RunningStatus bool
+	// Phantom is true if the status octet of the first command was not present in the
+	// original MIDI stream. The first command of a list always contains its status octet.
+	Phantom bool
 }
 
 // MIDIPayload contains the MIDI payload to be sent.
@@ -86,19 +104,94 @@ type MIDICommand struct {
 	Payload   MIDIPayload
 }
 
+// Errors returned by Decode
+var (
+	// ErrBufferTooSmall is returned when the buffer can not contain the RTP header.
+	ErrBufferTooSmall = errors.New("buffer is too small")
+	// ErrUnsupportedVersion is returned for RTP versions other than 2.
+	ErrUnsupportedVersion = errors.New("unsupported RTP version")
+	// ErrInvalidPadding is returned when the padding length exceeds the payload.
+	ErrInvalidPadding = errors.New("invalid padding")
+	// ErrTruncated is returned when a length field points beyond the buffer.
+	ErrTruncated = errors.New("truncated message")
+	// ErrMissingStatus is returned when a MIDI command does not start with a status octet.
+	ErrMissingStatus = errors.New("missing status octet")
+)
+
+// ErrCommandSectionTooLong is returned by Encode when the MIDI list does not fit into
+// the command section, see MIDICommands.Split.
+var ErrCommandSectionTooLong = errors.New("MIDI command section is too long")
+
+// MaxCommandSectionLength is the maximum length of the MIDI list of a single message.
+const MaxCommandSectionLength = 4095
+
 // Decode a byte buffer into a MIDIMessage
+//
+// The delta times of the decoded commands are set, the Commands.Timestamp is left
+// empty because the session start time of the remote participant is unknown.
 func Decode(buffer []byte) (msg MIDIMessage, err error) {
 	msg = MIDIMessage{}
 	if len(buffer) < minimumBufferLengt {
-		err = fmt.Errorf("buffer is too small: %d bytes", len(buffer))
+		err = fmt.Errorf("%w: %d bytes", ErrBufferTooSmall, len(buffer))
+		return
+	}
+	if buffer[0]&versionMask != version2Bit {
+		err = fmt.Errorf("%w: %d", ErrUnsupportedVersion, buffer[0]>>6)
+		return
+	}
+	if buffer[0]&paddingBit != 0 {
+		p := int(buffer[len(buffer)-1])
+		if p == 0 || p > len(buffer)-minimumBufferLengt {
+			err = fmt.Errorf("%w: %d octets", ErrInvalidPadding, p)
+			return
+		}
+		buffer = buffer[:len(buffer)-p]
+	}
+	msg.Marker = buffer[1]&markerBit != 0
+	msg.PayloadType = buffer[1] & ptMask
+	msg.SequenceNumber = binary.BigEndian.Uint16(buffer[2:4])
+	msg.Timestamp = binary.BigEndian.Uint32(buffer[4:8])
+	msg.SSRC = binary.BigEndian.Uint32(buffer[8:12])
+
+	offset := minimumBufferLengt
+	cc := int(buffer[0] & ccMask)
+	if len(buffer) < offset+cc*4 {
+		err = fmt.Errorf("%w: %d CSRC identifiers", ErrTruncated, cc)
+		return
+	}
+	for i := 0; i < cc; i++ {
+		msg.CSRC = append(msg.CSRC, binary.BigEndian.Uint32(buffer[offset:offset+4]))
+		offset += 4
+	}
+
+	if buffer[0]&extensionBit != 0 {
+		if len(buffer) < offset+4 {
+			err = fmt.Errorf("%w: header extension", ErrTruncated)
+			return
+		}
+		words := int(binary.BigEndian.Uint16(buffer[offset+2 : offset+4]))
+		offset += 4 + words*4
+		if len(buffer) < offset {
+			err = fmt.Errorf("%w: header extension", ErrTruncated)
+			return
+		}
+	}
+
+	n, journal, err := msg.Commands.decode(buffer[offset:])
+	if err != nil {
 		return
 	}
-	// FIXME implement decoder
+	if journal {
+		msg.Journal = append([]byte{}, buffer[offset+n:]...)
+	}
 	return
 }
 
 // Encode the MIDIMessage into a byte buffer.
-func Encode(m MIDIMessage, start time.Time) []byte {
+//
+// An error is returned if the MIDI list is longer than MaxCommandSectionLength
+// or if a delta time does not fit into four octets.
+func Encode(m MIDIMessage, start time.Time) ([]byte, error) {
 
 	b := new(bytes.Buffer)
 
@@ -109,9 +202,86 @@ func Encode(m MIDIMessage, start time.Time) []byte {
 	binary.Write(b, binary.BigEndian, uint32(ts))
 	binary.Write(b, binary.BigEndian, m.SSRC)
 
-	m.Commands.encode(b, start)
+	if err := m.Commands.encode(b, start); err != nil {
+		return nil, err
+	}
+
+	if len(m.Journal) > 0 {
+		b.Bytes()[minimumBufferLengt] |= journalBit
+		b.Write(m.Journal)
+	}
+
+	return b.Bytes(), nil
+}
+
+// Split divides the commands into lists which fit into the command section of a
+// single message each. Every list after the first one starts with the time of its
+// first command, the delta time of this command is zero. A list is also started
+// when a delta time does not fit into four octets. A SysEx which does not fit into
+// a single message is split into segments, see MIDIPayload.Segments.
+func (mcs MIDICommands) Split(start time.Time) ([]MIDICommands, error) {
+	mcs.Commands = mcs.segmented()
+	times := mcs.Times()
+	lists := []MIDICommands{}
+	current := MIDICommands{Timestamp: mcs.Timestamp, RunningStatus: mcs.RunningStatus, Phantom: mcs.Phantom}
+	length := 0
+	for i, mc := range mcs.Commands {
+		size, err := mc.length(current.Timestamp, start, len(current.Commands) == 0)
+		if err == nil && length+size <= MaxCommandSectionLength {
+			current.Commands = append(current.Commands, mc)
+			length += size
+			continue
+		}
+		if len(current.Commands) > 0 {
+			lists = append(lists, current)
+		}
+		mc.DeltaTime = 0
+		current = MIDICommands{Timestamp: times[i], Commands: []MIDICommand{mc}, RunningStatus: mcs.RunningStatus}
+		length = len(mc.Payload)
+		if length > MaxCommandSectionLength {
+			return nil, fmt.Errorf("%w: command of %d octets", ErrCommandSectionTooLong, length)
+		}
+	}
+	return append(lists, current), nil
+}
+
+// segmented returns the commands with every SysEx which does not fit into a single
+// message replaced by its segments.
+func (mcs MIDICommands) segmented() []MIDICommand {
+	commands := make([]MIDICommand, 0, len(mcs.Commands))
+	for _, mc := range mcs.Commands {
+		for i, segment := range mc.Payload.Segments(MaxCommandSectionLength) {
+			if i > 0 {
+				mc.DeltaTime = 0
+			}
+			commands = append(commands, MIDICommand{DeltaTime: mc.DeltaTime, Payload: segment})
+		}
+	}
+	return commands
+}
+
+// length returns the number of octets of the encoded delta time and payload.
+func (mc MIDICommand) length(reference, start time.Time, first bool) (int, error) {
+	if first && mc.DeltaTime == 0 {
+		return len(mc.Payload), nil
+	}
+	b := new(bytes.Buffer)
+	if err := timestamp.EncodeDeltaTime(reference, start, mc.DeltaTime, b); err != nil {
+		return 0, err
+	}
+	return b.Len() + len(mc.Payload), nil
+}
 
-	return b.Bytes()
+// Times returns the absolute time of each command. The delta time of each command
+// is relative to the previous command, the first one is relative to the Timestamp.
+func (mcs MIDICommands) Times() []time.Time {
+	times := make([]time.Time, len(mcs.Commands))
+	t := mcs.Timestamp
+	for i, mc := range mcs.Commands {
+		t = t.Add(mc.DeltaTime)
+		times[i] = t
+	}
+	return times
 }
 
 func (m MIDIMessage) String() string {
@@ -157,27 +327,35 @@ const (
 	lenMask      = 0x0f // Mask for the length information
 )
 
-func (mcs MIDICommands) encode(w io.Writer, start time.Time) {
+func (mcs MIDICommands) encode(w io.Writer, start time.Time) error {
 	if len(mcs.Commands) == 0 {
 		w.Write([]byte{emtpyHeader})
-		return
+		return nil
 	}
 	header := emtpyHeader
+	if mcs.Phantom {
+		header = header | phantomBit
+	}
 	b := new(bytes.Buffer)
 
+	running := byte(0)
 	for i, mc := range mcs.Commands {
 		if i == 0 && mc.DeltaTime > 0 {
 			header = header | zeroDeltaBit
-			timestamp.EncodeDeltaTime(mcs.Timestamp, start, mc.DeltaTime, b)
 		}
-		if i > 0 {
-			timestamp.EncodeDeltaTime(mcs.Timestamp, start, mc.DeltaTime, b)
+		if i > 0 || mc.DeltaTime > 0 {
+			if err := timestamp.EncodeDeltaTime(mcs.Timestamp, start, mc.DeltaTime, b); err != nil {
+				return err
+			}
+		}
+		mc.Payload.encode(b, mcs.RunningStatus && running != 0 && len(mc.Payload) > 0 && mc.Payload[0] == running)
+		if len(mc.Payload) > 0 {
+			running = runningStatus(running, mc.Payload[0])
 		}
-		mc.Payload.encode(b)
 	}
 
-	if b.Len() > 4095 {
-		// FIXME handle messages with size > 4095 octets (error and crop)
+	if b.Len() > MaxCommandSectionLength {
+		return fmt.Errorf("%w: %d octets", ErrCommandSectionTooLong, b.Len())
 	} else if b.Len() > 15 {
 		header = header | bigHeaderBit | (byte(b.Len()>>8) & lenMask)
 		count := byte(b.Len())
@@ -188,12 +366,139 @@ func (mcs MIDICommands) encode(w io.Writer, start time.Time) {
 	}
 
 	w.Write(b.Bytes())
+	return nil
 }
 
-func (p MIDIPayload) encode(w io.Writer) {
-	// FIXME maybe this encoding is not correct
+func (mcs *MIDICommands) decode(buffer []byte) (n int, journal bool, err error) {
+	if len(buffer) < 1 {
+		err = fmt.Errorf("%w: missing MIDI command section", ErrTruncated)
+		return
+	}
+	header := buffer[0]
+	length := int(header & lenMask)
+	n = 1
+	if header&bigHeaderBit != 0 {
+		if len(buffer) < 2 {
+			err = fmt.Errorf("%w: MIDI command section header", ErrTruncated)
+			return
+		}
+		length = length<<8 | int(buffer[1])
+		n = 2
+	}
+	if len(buffer) < n+length {
+		err = fmt.Errorf("%w: MIDI list of %d octets", ErrTruncated, length)
+		return
+	}
+	journal = header&journalBit != 0
+	mcs.Phantom = header&phantomBit != 0
+
+	list := buffer[n : n+length]
+	n += length
+	running := byte(0)
+	for i := 0; i < len(list); {
+		mc := MIDICommand{}
+		if i > 0 || header&zeroDeltaBit != 0 {
+			delta, size, dErr := timestamp.DecodeDeltaTime(list[i:])
+			if dErr != nil {
+				err = dErr
+				return
+			}
+			mc.DeltaTime = delta
+			i += size
+			if i == len(list) {
+				// the list may end with a delta time without a command
+				break
+			}
+		}
+		if list[i] < 0x80 {
+			// running status
+			if running == 0 {
+				err = fmt.Errorf("%w: 0x%x", ErrMissingStatus, list[i])
+				return
+			}
+			size := dataLength(running)
+			if i+size > len(list) {
+				err = fmt.Errorf("%w: MIDI command 0x%x", ErrTruncated, running)
+				return
+			}
+			mc.Payload = append(MIDIPayload{running}, list[i:i+size]...)
+			i += size
+		} else {
+			size, pErr := payloadLength(list[i:])
+			if pErr != nil {
+				err = pErr
+				return
+			}
+			mc.Payload = append(MIDIPayload{}, list[i:i+size]...)
+			i += size
+		}
+		running = runningStatus(running, mc.Payload[0])
+		mcs.Commands = append(mcs.Commands, mc)
+	}
+	return
+}
+
+// runningStatus returns the running status after a command with the given status.
+// Channel voice commands set the running status, System Common commands (including
+// SysEx) cancel it and System Real-time commands do not affect it.
+func runningStatus(running, status byte) byte {
+	switch {
+	case status >= 0x80 && status < 0xf0:
+		return status
+	case status >= 0xf0 && status < 0xf8:
+		return 0
+	}
+	return running
+}
+
+// dataLength returns the number of data octets of a channel voice command.
+func dataLength(status byte) int {
+	if status >= 0xc0 && status < 0xe0 {
+		return 1
+	}
+	return 2
+}
+
+// payloadLength returns the length of the MIDI command at the start of the buffer.
+func payloadLength(buffer []byte) (length int, err error) {
+	status := buffer[0]
+	switch {
+	case status < 0x80:
+		return 0, fmt.Errorf("%w: 0x%x", ErrMissingStatus, status)
+	case status < 0xf0:
+		length = 1 + dataLength(status)
+	case status == sysExStart, status == sysExEnd:
+		// a SysEx or a SysEx segment ends with 0xF7, 0xF0 or 0xF4
+		for length = 1; length < len(buffer); length++ {
+			if c := buffer[length]; c == sysExStart || c == sysExEnd || c == sysExCancel {
+				break
+			}
+		}
+		if length == len(buffer) {
+			return 0, fmt.Errorf("%w: SysEx without end", ErrTruncated)
+		}
+		length++
+	case status == 0xf1, status == 0xf3:
+		length = 2
+	case status == 0xf2:
+		length = 3
+	default:
+		length = 1
+	}
+	if length > len(buffer) {
+		return 0, fmt.Errorf("%w: MIDI command 0x%x", ErrTruncated, status)
+	}
+	return
+}
+
+// encode writes the payload, the status octet is omitted for running status.
+func (p MIDIPayload) encode(w io.Writer, running bool) {
 	if len(p) == 0 {
 		return
 	}
+	if running {
+		w.Write(p[1:])
+		return
+	}
 	w.Write(p)
 }
@@ -2,9 +2,11 @@ package rtp
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/laenzlinger/go-midi-rtp/timestamp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,8 +25,9 @@ func Test_encode_of_message(t *testing.T) {
 	}
 
 	// when
-	b := Encode(m, start)
+	b, err := Encode(m, start)
 	// then
+	assert.Nil(t, err)
 	assert.Equal(t, []byte{
 		0x80, 0x61, 0xaa, 0xbb, // Header | Sequence Number
 		0x00, 0x00, 0x00, 0x01, // Timestamp
@@ -33,6 +36,31 @@ func Test_encode_of_message(t *testing.T) {
 	}, b)
 }
 
+func Test_encode_of_message_with_journal(t *testing.T) {
+	// given
+	start := time.Now()
+	m := MIDIMessage{
+		SequenceNumber: 0xaabb,
+		SSRC:           0xccddeeff,
+		Commands: MIDICommands{
+			Commands:  []MIDICommand{{Payload: []byte{0x90, 0x3c, 0x40}}},
+			Timestamp: start,
+		},
+		Journal: []byte{0x80, 0xaa, 0xba},
+	}
+	// when
+	b, err := Encode(m, start)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0x80, 0x61, 0xaa, 0xbb, // Header | Sequence Number
+		0x00, 0x00, 0x00, 0x00, // Timestamp
+		0xcc, 0xdd, 0xee, 0xff, // SRCC
+		0x43, 0x90, 0x3c, 0x40, // MIDI Commands (J flag set)
+		0x80, 0xaa, 0xba, // Journal
+	}, b)
+}
+
 func Test_encode_of_empty_commands(t *testing.T) {
 	// given
 	m := MIDICommands{}
@@ -146,3 +174,327 @@ func Test_encode_of_mulitple_commands(t *testing.T) {
 		0x80, 0x3e, 0x00, // MIDI command (note off)
 	}, b.Bytes())
 }
+
+func Test_encode_with_running_status(t *testing.T) {
+	// given
+	now := time.Now()
+	b := new(bytes.Buffer)
+	mcs := MIDICommands{
+		Commands: []MIDICommand{
+			{Payload: []byte{0xb0, 0x07, 0x10}},
+			{Payload: []byte{0xb0, 0x07, 0x20}},
+			{Payload: []byte{0xf8}},
+			{Payload: []byte{0xb0, 0x07, 0x30}},
+			{Payload: []byte{0xf3, 0x01}},
+			{Payload: []byte{0xb0, 0x07, 0x40}},
+		},
+		Timestamp:     now,
+		RunningStatus: true,
+	}
+	// when
+	err := mcs.encode(b, now)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0x80, 0x12, // Header
+		0xb0, 0x07, 0x10, // MIDI command
+		0x00, 0x07, 0x20, // Running status
+		0x00, 0xf8, // System Real-time does not cancel running status
+		0x00, 0x07, 0x30, // Running status
+		0x00, 0xf3, 0x01, // System Common cancels running status
+		0x00, 0xb0, 0x07, 0x40, // MIDI command
+	}, b.Bytes())
+}
+
+func Test_decode_of_running_status(t *testing.T) {
+	// given
+	buffer := []byte{
+		0x1b,             // Header (P)
+		0xb0, 0x07, 0x10, // MIDI command
+		0x00, 0x07, 0x20, // Running status
+		0x00, 0xf8, // System Real-time
+		0x00, 0x07, 0x30, // Running status
+	}
+	mcs := MIDICommands{}
+	// when
+	_, _, err := mcs.decode(buffer)
+	// then
+	assert.Nil(t, err)
+	assert.True(t, mcs.Phantom)
+	assert.Equal(t, []MIDICommand{
+		{Payload: []byte{0xb0, 0x07, 0x10}},
+		{Payload: []byte{0xb0, 0x07, 0x20}},
+		{Payload: []byte{0xf8}},
+		{Payload: []byte{0xb0, 0x07, 0x30}},
+	}, mcs.Commands)
+}
+
+func Test_decode_of_running_status_after_system_common(t *testing.T) {
+	// given
+	buffer := []byte{
+		0x07,             // Header
+		0xb0, 0x07, 0x10, // MIDI command
+		0x00, 0xf6, // Tune Request cancels running status
+		0x00, 0x07, // Running status
+	}
+	mcs := MIDICommands{}
+	// when
+	_, _, err := mcs.decode(buffer)
+	// then
+	assert.True(t, errors.Is(err, ErrMissingStatus))
+}
+
+func Test_encode_of_too_long_command_section(t *testing.T) {
+	// given
+	now := time.Now()
+	m := MIDIMessage{Commands: MIDICommands{
+		Commands:  []MIDICommand{{Payload: sysex(MaxCommandSectionLength + 1)}},
+		Timestamp: now,
+	}}
+	// when
+	b, err := Encode(m, now)
+	// then
+	assert.True(t, errors.Is(err, ErrCommandSectionTooLong))
+	assert.Nil(t, b)
+}
+
+func Test_encode_of_overflowing_delta_time(t *testing.T) {
+	// given
+	now := time.Now()
+	m := MIDIMessage{Commands: MIDICommands{
+		Commands: []MIDICommand{
+			{Payload: []byte{0x90, 0x3c, 0x40}},
+			{Payload: []byte{0x80, 0x3c, 0x00}, DeltaTime: 8 * time.Hour},
+		},
+		Timestamp: now,
+	}}
+	// when
+	_, err := Encode(m, now)
+	// then
+	assert.True(t, errors.Is(err, timestamp.ErrDeltaTimeOverflow))
+}
+
+func Test_split_of_long_command_list(t *testing.T) {
+	// given
+	now := time.Now()
+	mcs := MIDICommands{
+		Commands: []MIDICommand{
+			{Payload: sysex(2000)},
+			{Payload: sysex(2000), DeltaTime: time.Millisecond},
+			{Payload: sysex(2000), DeltaTime: time.Millisecond},
+		},
+		Timestamp: now,
+	}
+	// when
+	lists, err := mcs.Split(now)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []MIDICommands{
+		{Timestamp: now, Commands: []MIDICommand{mcs.Commands[0], mcs.Commands[1]}},
+		{Timestamp: now.Add(2 * time.Millisecond), Commands: []MIDICommand{{Payload: sysex(2000)}}},
+	}, lists)
+	for _, l := range lists {
+		_, err := Encode(MIDIMessage{Commands: l}, now)
+		assert.Nil(t, err)
+	}
+}
+
+func Test_split_of_overflowing_delta_time(t *testing.T) {
+	// given
+	now := time.Now()
+	mcs := MIDICommands{
+		Commands: []MIDICommand{
+			{Payload: []byte{0x90, 0x3c, 0x40}},
+			{Payload: []byte{0x80, 0x3c, 0x00}, DeltaTime: 8 * time.Hour},
+		},
+		Timestamp: now,
+	}
+	// when
+	lists, err := mcs.Split(now)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []MIDICommands{
+		{Timestamp: now, Commands: []MIDICommand{{Payload: []byte{0x90, 0x3c, 0x40}}}},
+		{Timestamp: now.Add(8 * time.Hour), Commands: []MIDICommand{{Payload: []byte{0x80, 0x3c, 0x00}}}},
+	}, lists)
+}
+
+func Test_split_of_too_long_command(t *testing.T) {
+	// given
+	p := sysex(MaxCommandSectionLength + 1)
+	p[len(p)-1] = 0x00 // not terminated
+	mcs := MIDICommands{Commands: []MIDICommand{{Payload: p}}}
+	// when
+	_, err := mcs.Split(time.Now())
+	// then
+	assert.True(t, errors.Is(err, ErrCommandSectionTooLong))
+}
+
+// sysex returns a SysEx command of the given length.
+func sysex(length int) MIDIPayload {
+	p := make(MIDIPayload, length)
+	p[0], p[length-1] = 0xf0, 0xf7
+	return p
+}
+
+func Test_decode_of_message(t *testing.T) {
+	// given
+	b := []byte{
+		0x80, 0x61, 0xaa, 0xbb, // Header | Sequence Number
+		0x00, 0x00, 0x00, 0x01, // Timestamp
+		0xcc, 0xdd, 0xee, 0xff, // SRCC
+		0x03, 0x90, 0x3c, 0x40, // MIDI Commands
+	}
+	// when
+	m, err := Decode(b)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0xaabb), m.SequenceNumber)
+	assert.Equal(t, uint32(0x01), m.Timestamp)
+	assert.Equal(t, uint32(0xccddeeff), m.SSRC)
+	assert.Equal(t, uint8(0x61), m.PayloadType)
+	assert.False(t, m.Marker)
+	assert.Equal(t, []MIDICommand{{Payload: []byte{0x90, 0x3c, 0x40}}}, m.Commands.Commands)
+	assert.Nil(t, m.Journal)
+}
+
+func Test_decode_of_mulitple_commands(t *testing.T) {
+	// given
+	b := []byte{
+		0x80, 0x61, 0x00, 0x01, // Header | Sequence Number
+		0x00, 0x00, 0x00, 0x00, // Timestamp
+		0x00, 0x00, 0x00, 0x01, // SRCC
+		0xa0, 0x12, // Header (Z flag set)
+		0x64,             // Delta time (100 ticks)
+		0x90, 0x3c, 0x40, // MIDI command (note on)
+		0xce, 0x10, // Delta time (10000 ticks)
+		0x80, 0x3c, 0x00, // MIDI command (note off)
+		0x00,             // Delta time (0 ticks)
+		0x90, 0x3e, 0x40, // MIDI command (note on)
+		0xce, 0x10, // Delta time (10000 ticks)
+		0x80, 0x3e, 0x00, // MIDI command (note off)
+	}
+	// when
+	m, err := Decode(b)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []MIDICommand{
+		{Payload: []byte{0x90, 0x3c, 0x40}, DeltaTime: 10 * time.Millisecond},
+		{Payload: []byte{0x80, 0x3c, 0x00}, DeltaTime: time.Second},
+		{Payload: []byte{0x90, 0x3e, 0x40}},
+		{Payload: []byte{0x80, 0x3e, 0x00}, DeltaTime: time.Second},
+	}, m.Commands.Commands)
+}
+
+func Test_decode_skips_csrc_extension_and_padding(t *testing.T) {
+	// given
+	b := []byte{
+		0xb1, 0xe1, 0x00, 0x01, // Header (P, X, CC=1, M) | Sequence Number
+		0x00, 0x00, 0x00, 0x00, // Timestamp
+		0x00, 0x00, 0x00, 0x01, // SRCC
+		0x11, 0x22, 0x33, 0x44, // CSRC
+		0xbe, 0xde, 0x00, 0x01, // Extension header
+		0x01, 0x02, 0x03, 0x04, // Extension
+		0x02, 0xc0, 0x05, // MIDI Commands
+		0x00, 0x00, 0x03, // Padding
+	}
+	// when
+	m, err := Decode(b)
+	// then
+	assert.Nil(t, err)
+	assert.True(t, m.Marker)
+	assert.Equal(t, []uint32{0x11223344}, m.CSRC)
+	assert.Equal(t, []MIDICommand{{Payload: []byte{0xc0, 0x05}}}, m.Commands.Commands)
+}
+
+func Test_decode_of_journal_section(t *testing.T) {
+	// given
+	b := []byte{
+		0x80, 0x61, 0x00, 0x01, // Header | Sequence Number
+		0x00, 0x00, 0x00, 0x00, // Timestamp
+		0x00, 0x00, 0x00, 0x01, // SRCC
+		0x47, 0xf0, 0x01, 0x02, 0x03, 0xf7, 0x00, 0xf8, // MIDI Commands (J flag set)
+		0x00, 0x00, 0x00, // Journal
+	}
+	// when
+	m, err := Decode(b)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []MIDICommand{
+		{Payload: []byte{0xf0, 0x01, 0x02, 0x03, 0xf7}},
+		{Payload: []byte{0xf8}},
+	}, m.Commands.Commands)
+	assert.Equal(t, []byte{0x00, 0x00, 0x00}, m.Journal)
+}
+
+func Test_decode_errors(t *testing.T) {
+	header := []byte{0x80, 0x61, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}
+	tests := []struct {
+		name   string
+		buffer []byte
+		err    error
+	}{
+		{"too small", []byte{0x80, 0x61}, ErrBufferTooSmall},
+		{"version", append([]byte{0x40}, header[1:]...), ErrUnsupportedVersion},
+		{"padding", append([]byte{0xa0}, append(header[1:], 0x00, 0x10)...), ErrInvalidPadding},
+		{"missing command section", header, ErrTruncated},
+		{"csrc", append([]byte{0x81}, header[1:]...), ErrTruncated},
+		{"list length", append(header, 0x04, 0x90, 0x3c), ErrTruncated},
+		{"command length", append(header, 0x02, 0x90, 0x3c), ErrTruncated},
+		{"missing status", append(header, 0x02, 0x3c, 0x40), ErrMissingStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// when
+			_, err := Decode(tt.buffer)
+			// then
+			assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+		})
+	}
+}
+
+func Test_encode_decode_roundtrip(t *testing.T) {
+	// given
+	start := time.Now()
+	m := MIDIMessage{
+		SequenceNumber: 0x1234,
+		SSRC:           0x11223344,
+		Commands: MIDICommands{
+			Timestamp: start,
+			Commands: []MIDICommand{
+				{Payload: []byte{0x90, 0x3c, 0x40}, DeltaTime: time.Millisecond},
+				{Payload: []byte{0xe0, 0x00, 0x40}, DeltaTime: 2 * time.Millisecond},
+			},
+		},
+	}
+	// when
+	b, eErr := Encode(m, start)
+	actual, err := Decode(b)
+	// then
+	assert.Nil(t, eErr)
+	assert.Nil(t, err)
+	assert.Equal(t, m.SequenceNumber, actual.SequenceNumber)
+	assert.Equal(t, m.SSRC, actual.SSRC)
+	assert.Equal(t, m.Commands.Commands, actual.Commands.Commands)
+}
+
+func Test_command_times(t *testing.T) {
+	// given
+	now := time.Now()
+	mcs := MIDICommands{
+		Timestamp: now,
+		Commands: []MIDICommand{
+			{Payload: []byte{0x90, 0x3c, 0x40}, DeltaTime: time.Millisecond},
+			{Payload: []byte{0x80, 0x3c, 0x00}, DeltaTime: time.Second},
+			{Payload: []byte{0x90, 0x3e, 0x40}},
+		},
+	}
+	// when
+	times := mcs.Times()
+	// then
+	assert.Equal(t, []time.Time{
+		now.Add(time.Millisecond),
+		now.Add(time.Second + time.Millisecond),
+		now.Add(time.Second + time.Millisecond),
+	}, times)
+}
@@ -0,0 +1,125 @@
+package rtp
+
+import "time"
+
+// MIDI System Exclusive octets
+const (
+	sysExStart  = 0xf0
+	sysExEnd    = 0xf7
+	sysExCancel = 0xf4
+)
+
+// Segment is the part of a System Exclusive command contained in a MIDIPayload.
+//
+// A SysEx which does not fit into a single message is split into segments:
+// the first segment ends with 0xF0, middle segments start with 0xF7 and end with 0xF0,
+// the last segment starts with 0xF7 and ends with 0xF7. A segment ending with 0xF4
+// cancels the SysEx. See https://tools.ietf.org/html/rfc6295#section-3.2
+type Segment int
+
+// The segments of a System Exclusive command
+const (
+	// NoSysEx is returned for all other commands.
+	NoSysEx Segment = iota
+	// CompleteSysEx is a SysEx which is not segmented (0xF0 ... 0xF7).
+	CompleteSysEx
+	// FirstSegment is the first segment of a SysEx (0xF0 ... 0xF0).
+	FirstSegment
+	// MiddleSegment is a middle segment of a SysEx (0xF7 ... 0xF0).
+	MiddleSegment
+	// LastSegment is the last segment of a SysEx (0xF7 ... 0xF7).
+	LastSegment
+	// CancelledSegment cancels the segmented SysEx (... 0xF4).
+	CancelledSegment
+)
+
+// Segment returns the SysEx segment of the payload.
+func (p MIDIPayload) Segment() Segment {
+	if len(p) < 2 || (p[0] != sysExStart && p[0] != sysExEnd) {
+		return NoSysEx
+	}
+	switch last := p[len(p)-1]; {
+	case last == sysExCancel:
+		return CancelledSegment
+	case p[0] == sysExStart && last == sysExEnd:
+		return CompleteSysEx
+	case p[0] == sysExStart && last == sysExStart:
+		return FirstSegment
+	case p[0] == sysExEnd && last == sysExStart:
+		return MiddleSegment
+	case p[0] == sysExEnd && last == sysExEnd:
+		return LastSegment
+	}
+	return NoSysEx
+}
+
+// Segments splits a complete SysEx into segments of at most size octets.
+// All other payloads and SysEx which fit are returned unchanged.
+func (p MIDIPayload) Segments(size int) []MIDIPayload {
+	if len(p) <= size || size < 3 || p.Segment() != CompleteSysEx {
+		return []MIDIPayload{p}
+	}
+	data := p[1 : len(p)-1]
+	segments := []MIDIPayload{}
+	start := byte(sysExStart)
+	for len(data) > size-2 {
+		segments = append(segments, append(append(MIDIPayload{start}, data[:size-2]...), sysExStart))
+		data = data[size-2:]
+		start = sysExEnd
+	}
+	return append(segments, append(append(MIDIPayload{sysExEnd}, data...), sysExEnd))
+}
+
+// SysExAssembler reassembles segmented System Exclusive commands of a stream.
+// The zero value is ready to use.
+type SysExAssembler struct {
+	pending MIDIPayload
+	started bool
+}
+
+// Assemble replaces the SysEx segments in the commands by the complete SysEx which
+// is delivered with the last segment. Incomplete and cancelled segments are removed,
+// their delta times are added to the next command.
+func (a *SysExAssembler) Assemble(mcs MIDICommands) MIDICommands {
+	commands := make([]MIDICommand, 0, len(mcs.Commands))
+	delta := time.Duration(0)
+	for _, mc := range mcs.Commands {
+		mc.DeltaTime += delta
+		delta = 0
+		payload, complete := a.add(mc.Payload)
+		if !complete {
+			delta = mc.DeltaTime
+			continue
+		}
+		mc.Payload = payload
+		commands = append(commands, mc)
+	}
+	mcs.Commands = commands
+	return mcs
+}
+
+// add returns the payload to be delivered and true, or false if the payload is
+// an incomplete segment.
+func (a *SysExAssembler) add(p MIDIPayload) (MIDIPayload, bool) {
+	switch p.Segment() {
+	case FirstSegment:
+		a.pending = append(MIDIPayload{}, p[:len(p)-1]...)
+		a.started = true
+	case MiddleSegment:
+		if a.started {
+			a.pending = append(a.pending, p[1:len(p)-1]...)
+		}
+	case LastSegment:
+		if !a.started {
+			return nil, false
+		}
+		complete := append(append(a.pending, p[1:len(p)-1]...), sysExEnd)
+		a.pending, a.started = nil, false
+		return complete, true
+	case CancelledSegment:
+		a.pending, a.started = nil, false
+	default:
+		return p, true
+	}
+	return nil, false
+}
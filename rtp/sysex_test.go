@@ -0,0 +1,101 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_segment_of_payload(t *testing.T) {
+	tests := []struct {
+		payload  MIDIPayload
+		expected Segment
+	}{
+		{MIDIPayload{0x90, 0x3c, 0x40}, NoSysEx},
+		{MIDIPayload{0xf0, 0x01, 0xf7}, CompleteSysEx},
+		{MIDIPayload{0xf0, 0x01, 0xf0}, FirstSegment},
+		{MIDIPayload{0xf7, 0x01, 0xf0}, MiddleSegment},
+		{MIDIPayload{0xf7, 0x01, 0xf7}, LastSegment},
+		{MIDIPayload{0xf7, 0xf4}, CancelledSegment},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.payload.Segment(), "%x", test.payload)
+	}
+}
+
+func Test_segments_of_sysex(t *testing.T) {
+	// given
+	p := MIDIPayload{0xf0, 0x01, 0x02, 0x03, 0x04, 0x05, 0xf7}
+	// when
+	segments := p.Segments(4)
+	// then
+	assert.Equal(t, []MIDIPayload{
+		{0xf0, 0x01, 0x02, 0xf0},
+		{0xf7, 0x03, 0x04, 0xf0},
+		{0xf7, 0x05, 0xf7},
+	}, segments)
+}
+
+func Test_decode_of_segments(t *testing.T) {
+	// given
+	buffer := []byte{
+		0x08,                   // Header
+		0xf7, 0x03, 0x04, 0xf0, // Middle segment
+		0x00, 0xf7, 0x05, 0xf7, // Last segment
+	}
+	mcs := MIDICommands{}
+	// when
+	_, _, err := mcs.decode(buffer)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, []MIDICommand{
+		{Payload: []byte{0xf7, 0x03, 0x04, 0xf0}},
+		{Payload: []byte{0xf7, 0x05, 0xf7}},
+	}, mcs.Commands)
+}
+
+func Test_split_of_long_sysex(t *testing.T) {
+	// given
+	now := time.Now()
+	mcs := MIDICommands{
+		Commands: []MIDICommand{
+			{Payload: []byte{0x90, 0x3c, 0x40}},
+			{Payload: sysex(2 * MaxCommandSectionLength), DeltaTime: time.Millisecond},
+		},
+		Timestamp: now,
+	}
+	// when
+	lists, err := mcs.Split(now)
+	// then
+	assert.Nil(t, err)
+	assert.Len(t, lists, 4)
+	a := SysExAssembler{}
+	assembled := []MIDICommand{}
+	for _, l := range lists {
+		b, err := Encode(MIDIMessage{Commands: l}, now)
+		assert.Nil(t, err)
+		msg, err := Decode(b)
+		assert.Nil(t, err)
+		assembled = append(assembled, a.Assemble(msg.Commands).Commands...)
+	}
+	assert.Equal(t, []MIDICommand{
+		{Payload: []byte{0x90, 0x3c, 0x40}},
+		{Payload: sysex(2 * MaxCommandSectionLength)},
+	}, assembled)
+}
+
+func Test_assembler_drops_incomplete_sysex(t *testing.T) {
+	// given
+	a := SysExAssembler{}
+	a.Assemble(MIDICommands{Commands: []MIDICommand{{Payload: []byte{0xf0, 0x01, 0xf0}}}})
+	// when
+	cancelled := a.Assemble(MIDICommands{Commands: []MIDICommand{
+		{Payload: []byte{0xf7, 0x02, 0xf4}, DeltaTime: time.Millisecond},
+		{Payload: []byte{0x90, 0x3c, 0x40}, DeltaTime: time.Millisecond},
+	}})
+	orphan := a.Assemble(MIDICommands{Commands: []MIDICommand{{Payload: []byte{0xf7, 0x03, 0xf7}}}})
+	// then
+	assert.Equal(t, []MIDICommand{{Payload: []byte{0x90, 0x3c, 0x40}, DeltaTime: 2 * time.Millisecond}}, cancelled.Commands)
+	assert.Empty(t, orphan.Commands)
+}
@@ -0,0 +1,116 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+
+	"github.com/laenzlinger/go-midi-rtp/sip"
+)
+
+// Reasons returned by the built-in invitation policies
+var (
+	// ErrNotAllowed is returned when the remote participant is not on the allowlist.
+	ErrNotAllowed = errors.New("not allowed")
+	// ErrDenied is returned when the remote participant is on the denylist.
+	ErrDenied = errors.New("denied")
+	// ErrTooManyConnections is returned when the maximum number of streams is reached.
+	ErrTooManyConnections = errors.New("too many connections")
+)
+
+// AllowNames accepts only remote participants whose name matches one of the
+// patterns. The patterns use the syntax of path.Match, e.g. "Studio *".
+// Malformed patterns never match.
+func AllowNames(patterns ...string) InvitationPolicy {
+	return func(msg sip.ControlMessage, addr net.Addr) error {
+		if !matchName(msg.Name, patterns) {
+			return fmt.Errorf("%w: name %q", ErrNotAllowed, msg.Name)
+		}
+		return nil
+	}
+}
+
+// DenyNames refuses remote participants whose name matches one of the patterns,
+// see AllowNames.
+func DenyNames(patterns ...string) InvitationPolicy {
+	return func(msg sip.ControlMessage, addr net.Addr) error {
+		if matchName(msg.Name, patterns) {
+			return fmt.Errorf("%w: name %q", ErrDenied, msg.Name)
+		}
+		return nil
+	}
+}
+
+// AllowNetworks accepts only remote participants with an address in one of the
+// networks, e.g. netip.MustParsePrefix("192.168.1.0/24").
+func AllowNetworks(networks ...netip.Prefix) InvitationPolicy {
+	return func(msg sip.ControlMessage, addr net.Addr) error {
+		if !containsAddr(addr, networks) {
+			return fmt.Errorf("%w: address %v", ErrNotAllowed, addr)
+		}
+		return nil
+	}
+}
+
+// DenyNetworks refuses remote participants with an address in one of the networks.
+func DenyNetworks(networks ...netip.Prefix) InvitationPolicy {
+	return func(msg sip.ControlMessage, addr net.Addr) error {
+		if containsAddr(addr, networks) {
+			return fmt.Errorf("%w: address %v", ErrDenied, addr)
+		}
+		return nil
+	}
+}
+
+// WithMaxConnections refuses invitations of new remote participants once the
+// session has the given number of streams.
+func WithMaxConnections(max int) Option {
+	return func(s *MIDINetworkSession) {
+		s.invitationPolicies = append(s.invitationPolicies, func(msg sip.ControlMessage, addr net.Addr) error {
+			if count := s.connectionCount(); count >= max {
+				return fmt.Errorf("%w: %d streams", ErrTooManyConnections, count)
+			}
+			return nil
+		})
+	}
+}
+
+func matchName(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(addr net.Addr, networks []netip.Prefix) bool {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of a UDP address.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		ip, ok := netip.AddrFromSlice(udp.IP)
+		return ip.Unmap(), ok
+	}
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
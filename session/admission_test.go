@@ -0,0 +1,54 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/laenzlinger/go-midi-rtp/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_name_policies(t *testing.T) {
+	// given
+	allow := AllowNames("Studio *")
+	deny := DenyNames("*Laptop*", "[")
+	studio := sip.ControlMessage{Name: "Studio Mac"}
+	visitor := sip.ControlMessage{Name: "Visitor's Laptop"}
+	// then
+	assert.Nil(t, allow(studio, nil))
+	assert.True(t, errors.Is(allow(visitor, nil), ErrNotAllowed))
+	assert.Nil(t, deny(studio, nil))
+	assert.True(t, errors.Is(deny(visitor, nil), ErrDenied))
+}
+
+func Test_network_policies(t *testing.T) {
+	// given
+	allow := AllowNetworks(netip.MustParsePrefix("192.168.1.0/24"))
+	deny := DenyNetworks(netip.MustParsePrefix("192.168.1.128/25"), netip.MustParsePrefix("fe80::/10"))
+	studio := &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 5004}
+	visitor := &net.UDPAddr{IP: net.ParseIP("192.168.1.200"), Port: 5004}
+	linkLocal := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 5004}
+	// then
+	assert.Nil(t, allow(sip.ControlMessage{}, studio))
+	assert.Nil(t, allow(sip.ControlMessage{}, visitor))
+	assert.True(t, errors.Is(allow(sip.ControlMessage{}, linkLocal), ErrNotAllowed))
+	assert.Nil(t, deny(sip.ControlMessage{}, studio))
+	assert.True(t, errors.Is(deny(sip.ControlMessage{}, visitor), ErrDenied))
+	assert.True(t, errors.Is(deny(sip.ControlMessage{}, linkLocal), ErrDenied))
+}
+
+func Test_invitations_beyond_max_connections_are_rejected(t *testing.T) {
+	// given
+	st := newSessionTest(t, WithMaxConnections(1), pausedMaintenance)
+	defer st.close()
+	st.s.connections.Store(uint32(3), &MIDINetworkStream{RemoteSSRC: 3})
+	// when
+	answer := st.invite(st.control, 7)
+	// then
+	assert.Equal(t, sip.InvitationRejected, answer)
+	assert.True(t, errors.Is(st.s.admit(sip.ControlMessage{}, nil), ErrTooManyConnections))
+	st.s.connections.Delete(uint32(3))
+	assert.Equal(t, sip.InvitationAccepted, st.invite(st.control, 7))
+}
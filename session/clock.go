@@ -0,0 +1,44 @@
+package session
+
+import (
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/timestamp"
+)
+
+// clockFilterWeight defines how much a new sample influences the estimate
+const clockFilterWeight = 0.125
+
+// clockEstimate keeps the filtered clock offset and round-trip latency
+// calculated from completed synchronizations (CK0, CK1, CK2).
+//
+// Timestamps ts1 and ts3 are taken by the initiator, ts2 by the responder.
+type clockEstimate struct {
+	// offset of the responder clock relative to the initiator clock in ticks
+	offset float64
+	// latency is the round trip time in ticks
+	latency float64
+	samples int
+}
+
+// update adds a completed synchronization to the estimate.
+func (c *clockEstimate) update(ts1, ts2, ts3 uint64) {
+	latency := float64(int64(ts3 - ts1))
+	offset := float64(int64(ts2)) - (float64(ts1)+float64(ts3))/2
+	if c.samples == 0 {
+		c.offset = offset
+		c.latency = latency
+	} else {
+		c.offset += clockFilterWeight * (offset - c.offset)
+		c.latency += clockFilterWeight * (latency - c.latency)
+	}
+	c.samples++
+}
+
+func (c *clockEstimate) synchronized() bool {
+	return c.samples > 0
+}
+
+func ticks(t float64) time.Duration {
+	return time.Duration(t * float64(timestamp.Timestamp(1).Duration()))
+}
@@ -0,0 +1,40 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_first_sample_defines_the_estimate(t *testing.T) {
+	// given
+	c := clockEstimate{}
+	// when
+	c.update(1000, 5050, 1100)
+	// then
+	assert.True(t, c.synchronized())
+	assert.Equal(t, 4000.0, c.offset)
+	assert.Equal(t, 100.0, c.latency)
+	assert.Equal(t, 400*time.Millisecond, ticks(c.offset))
+}
+
+func Test_negative_offset(t *testing.T) {
+	// given
+	c := clockEstimate{}
+	// when
+	c.update(5000, 1050, 5100)
+	// then
+	assert.Equal(t, -4000.0, c.offset)
+}
+
+func Test_samples_are_filtered(t *testing.T) {
+	// given
+	c := clockEstimate{}
+	c.update(1000, 5050, 1100)
+	// when
+	c.update(2000, 6130, 2100)
+	// then
+	assert.Equal(t, 4010.0, c.offset)
+	assert.Equal(t, 100.0, c.latency)
+}
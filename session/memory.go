@@ -0,0 +1,176 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrAddressInUse is returned when a port of the MemoryNetwork is already open.
+var ErrAddressInUse = errors.New("address already in use")
+
+const (
+	memoryQueueLength   = 256
+	memoryEphemeralPort = 49152
+)
+
+// MemoryNetwork delivers the packets between the sessions of its transports
+// in memory. It allows sessions to talk to each other in tests without sockets.
+//
+// Like UDP, packets to closed ports or exceeding the queue of the receiver
+// are dropped.
+type MemoryNetwork struct {
+	mutex    sync.Mutex
+	conns    map[string]*memoryConn
+	nextPort uint16
+}
+
+// NewMemoryNetwork creates a new empty network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		conns:    map[string]*memoryConn{},
+		nextPort: memoryEphemeralPort,
+	}
+}
+
+// Transport returns the transport of the host with the given IP address.
+func (n *MemoryNetwork) Transport(ip net.IP) Transport {
+	return memoryTransport{network: n, ip: ip}
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	ip      net.IP
+}
+
+// ListenPacket opens the port of the host. Ephemeral ports are even, so the
+// following port is free for the MIDI port.
+func (t memoryTransport) ListenPacket(port uint16) (net.PacketConn, error) {
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	addr := &net.UDPAddr{IP: t.ip, Port: int(port)}
+	for port == 0 {
+		addr.Port = int(n.nextPort)
+		if n.nextPort += 2; n.nextPort < memoryEphemeralPort {
+			n.nextPort = memoryEphemeralPort
+		}
+		if _, found := n.conns[addr.String()]; !found {
+			port = uint16(addr.Port)
+		}
+	}
+	if _, found := n.conns[addr.String()]; found {
+		return nil, fmt.Errorf("%w: %v", ErrAddressInUse, addr)
+	}
+	conn := &memoryConn{
+		network: n,
+		addr:    addr,
+		packets: make(chan memoryPacket, memoryQueueLength),
+		done:    make(chan struct{}),
+	}
+	n.conns[addr.String()] = conn
+	return conn, nil
+}
+
+func (n *MemoryNetwork) deliver(from, to net.Addr, b []byte) {
+	n.mutex.Lock()
+	conn, found := n.conns[to.String()]
+	n.mutex.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case conn.packets <- memoryPacket{from: from, data: append([]byte{}, b...)}:
+	default:
+	}
+}
+
+func (n *MemoryNetwork) remove(conn *memoryConn) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.conns, conn.addr.String())
+}
+
+type memoryPacket struct {
+	from net.Addr
+	data []byte
+}
+
+// memoryConn is a net.PacketConn of a MemoryNetwork.
+type memoryConn struct {
+	network   *MemoryNetwork
+	addr      *net.UDPAddr
+	packets   chan memoryPacket
+	done      chan struct{}
+	closeOnce sync.Once
+	// deadlineMutex protects the read deadline which is checked when a read starts.
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+func (c *memoryConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	c.deadlineMutex.Lock()
+	deadline := c.readDeadline
+	c.deadlineMutex.Unlock()
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c.done:
+		return 0, nil, c.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+	case p := <-c.packets:
+		return copy(b, p.data), p.from, nil
+	}
+}
+
+func (c *memoryConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	c.network.deliver(c.addr, addr, b)
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	err := c.opError("close", net.ErrClosed)
+	c.closeOnce.Do(func() {
+		c.network.remove(c)
+		close(c.done)
+		err = nil
+	})
+	return err
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline has no effect, writes never block.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memoryConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memory", Addr: c.addr, Err: err}
+}
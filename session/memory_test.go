@@ -0,0 +1,150 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sessions_talk_over_memory_network(t *testing.T) {
+	// given
+	network := NewMemoryNetwork()
+	ctx := context.Background()
+	a, err := Start(ctx, "a", 5004, WithTransport(network.Transport(net.IPv4(10, 0, 0, 1))))
+	assert.Nil(t, err)
+	defer a.Close()
+	b, err := Start(ctx, "b", 5004, WithTransport(network.Transport(net.IPv4(10, 0, 0, 2))))
+	assert.Nil(t, err)
+	defer b.Close()
+	received := make(chan rtp.MIDICommands, 1)
+	b.HandleMIDI(func(conn *MIDINetworkStream, mcs rtp.MIDICommands) {
+		received <- mcs
+	})
+	// when
+	conn, err := a.Invite(ctx, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5004})
+	assert.Nil(t, err)
+	err = a.SendMIDIPayload([]byte{0x90, 0x3c, 0x40})
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, b.SSRC, conn.RemoteSSRC)
+	select {
+	case mcs := <-received:
+		assert.Equal(t, rtp.MIDIPayload{0x90, 0x3c, 0x40}, mcs.Commands[0].Payload)
+	case <-time.After(time.Second):
+		assert.Fail(t, "MIDI message not received")
+	}
+}
+
+func Test_memory_network_ports(t *testing.T) {
+	// given
+	transport := NewMemoryNetwork().Transport(net.IPv4(10, 0, 0, 1))
+	// when
+	s, err := Start(context.Background(), "ephemeral", 0, WithTransport(transport))
+	_, inUse := transport.ListenPacket(s.Port + 1)
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(memoryEphemeralPort), s.Port)
+	assert.True(t, errors.Is(inUse, ErrAddressInUse))
+	assert.Nil(t, s.Close())
+	pc, err := transport.ListenPacket(s.Port + 1)
+	assert.Nil(t, err)
+	pc.Close()
+}
+
+func Test_memory_conn_read_deadline(t *testing.T) {
+	// given
+	pc, _ := NewMemoryNetwork().Transport(nil).ListenPacket(0)
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	// when
+	_, _, err := pc.ReadFrom(make([]byte, 10))
+	// then
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func Test_session_with_packet_conns(t *testing.T) {
+	// given
+	transport := NewMemoryNetwork().Transport(net.IPv4(10, 0, 0, 1))
+	control, _ := transport.ListenPacket(6004)
+	midiPc, _ := transport.ListenPacket(6005)
+	// when
+	s, err := Start(context.Background(), "conns", 0, WithPacketConns(control, midiPc))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(6004), s.Port)
+	assert.Nil(t, s.Close())
+	assert.NotNil(t, control.Close())
+}
+
+func Test_session_with_missing_packet_conn(t *testing.T) {
+	// given
+	control, _ := NewMemoryNetwork().Transport(nil).ListenPacket(6004)
+	defer control.Close()
+	// when
+	_, missingMIDI := Start(context.Background(), "conns", 0, WithPacketConns(control, nil))
+	_, missingControl := Start(context.Background(), "conns", 0, WithPacketConns(nil, control))
+	// then
+	assert.True(t, errors.Is(missingMIDI, ErrMissingPacketConn))
+	assert.True(t, errors.Is(missingControl, ErrMissingPacketConn))
+}
+
+// ephemeralTransport opens the given ports instead of ephemeral ports.
+type ephemeralTransport struct {
+	Transport
+	ports []uint16
+}
+
+func (t *ephemeralTransport) ListenPacket(port uint16) (net.PacketConn, error) {
+	if port == 0 {
+		port, t.ports = t.ports[0], t.ports[1:]
+	}
+	return t.Transport.ListenPacket(port)
+}
+
+func Test_ephemeral_port_is_retried_if_midi_port_is_in_use(t *testing.T) {
+	// given
+	transport := NewMemoryNetwork().Transport(net.IPv4(10, 0, 0, 1))
+	pc, _ := transport.ListenPacket(memoryEphemeralPort + 1)
+	defer pc.Close()
+	// when
+	s, err := Start(context.Background(), "ephemeral", 0, WithTransport(transport))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(memoryEphemeralPort+2), s.Port)
+	assert.Nil(t, s.Close())
+	released, err := transport.ListenPacket(memoryEphemeralPort)
+	assert.Nil(t, err)
+	released.Close()
+}
+
+func Test_ephemeral_port_65535_is_retried(t *testing.T) {
+	// given
+	transport := &ephemeralTransport{
+		Transport: NewMemoryNetwork().Transport(net.IPv4(10, 0, 0, 1)),
+		ports:     []uint16{65535, 6004},
+	}
+	// when
+	s, err := Start(context.Background(), "ephemeral", 0, WithTransport(transport))
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(6004), s.Port)
+	assert.Nil(t, s.Close())
+	released, err := transport.ListenPacket(65535)
+	assert.Nil(t, err)
+	released.Close()
+}
+
+func Test_control_port_65535_is_rejected(t *testing.T) {
+	// given
+	transport := NewMemoryNetwork().Transport(net.IPv4(10, 0, 0, 1))
+	// when
+	_, err := Start(context.Background(), "last", 65535, WithTransport(transport))
+	// then
+	assert.True(t, errors.Is(err, ErrInvalidPort))
+}
@@ -0,0 +1,93 @@
+package session
+
+import (
+	"net"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/sip"
+)
+
+// Option configures a MIDINetworkSession when it is started.
+type Option func(*MIDINetworkSession)
+
+// SyncSchedule defines when the initiator of a stream synchronizes the clocks
+// with the remote participant.
+type SyncSchedule struct {
+	// BurstCount is the number of synchronizations sent with BurstInterval
+	// right after the invitation was accepted.
+	BurstCount    int
+	BurstInterval time.Duration
+	// Interval between the synchronizations after the burst.
+	Interval time.Duration
+}
+
+// DefaultSyncSchedule behaves similar to the Apple MIDI Network Driver.
+var DefaultSyncSchedule = SyncSchedule{
+	BurstCount:    6,
+	BurstInterval: 1500 * time.Millisecond,
+	Interval:      10 * time.Second,
+}
+
+// DefaultReceiverFeedbackInterval is the interval in which the received sequence number
+// is reported to the sender.
+const DefaultReceiverFeedbackInterval = time.Second
+
+// DefaultPeerTimeout is the time after which a silent remote participant is removed.
+const DefaultPeerTimeout = 60 * time.Second
+
+// WithSyncSchedule sets the schedule of the clock synchronization.
+func WithSyncSchedule(schedule SyncSchedule) Option {
+	return func(s *MIDINetworkSession) {
+		s.syncSchedule = schedule
+	}
+}
+
+// WithPeerTimeout sets the time after which a remote participant which neither
+// answered a synchronization nor sent any message is removed from the session.
+func WithPeerTimeout(timeout time.Duration) Option {
+	return func(s *MIDINetworkSession) {
+		s.peerTimeout = timeout
+	}
+}
+
+// WithReceiverFeedbackInterval sets the interval in which the highest received sequence
+// number is reported to the sender with a receiver feedback (RS) message.
+func WithReceiverFeedbackInterval(interval time.Duration) Option {
+	return func(s *MIDINetworkSession) {
+		s.feedbackInterval = interval
+	}
+}
+
+// WithEnhancedChapterC enables the enhanced Chapter C encoding of the recovery journal.
+// Switch controllers like the sustain pedal are additionally coded with their number
+// of toggles.
+func WithEnhancedChapterC() Option {
+	return func(s *MIDINetworkSession) {
+		s.enhancedChapterC = true
+	}
+}
+
+// WithRunningStatus enables running status in the command section of the sent
+// messages. The status octet of consecutive channel voice commands with the same
+// status is omitted.
+func WithRunningStatus() Option {
+	return func(s *MIDINetworkSession) {
+		s.runningStatus = true
+	}
+}
+
+// InvitationPolicy decides whether the invitation of a new remote participant is
+// accepted. The invitation message carries the name and the SSRC of the remote
+// participant, addr is the address of its control port.
+// The invitation is answered with NO when an error is returned.
+//
+// See AllowNames, DenyNames, AllowNetworks and DenyNetworks for built-in policies.
+type InvitationPolicy func(msg sip.ControlMessage, addr net.Addr) error
+
+// WithInvitationPolicy adds a policy which has to accept the invitations of new
+// remote participants. An invitation is only accepted if all policies accept it.
+func WithInvitationPolicy(policy InvitationPolicy) Option {
+	return func(s *MIDINetworkSession) {
+		s.invitationPolicies = append(s.invitationPolicies, policy)
+	}
+}
@@ -1,44 +1,234 @@
 package session
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/laenzlinger/go-midi-rtp/midi"
 	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/laenzlinger/go-midi-rtp/rtp/recoveryjournal"
 	"github.com/laenzlinger/go-midi-rtp/sip"
 )
 
 // MIDINetworkSession can offer or accept streams.
 type MIDINetworkSession struct {
-	LocalName      string
-	BonjourName    string
-	Port           uint16
-	SSRC           uint32
-	SequenceNumber uint16
-	StartTime      time.Time
-	connections    sync.Map
+	LocalName        string
+	BonjourName      string
+	Port             uint16
+	SSRC             uint32
+	SequenceNumber   uint16
+	StartTime        time.Time
+	connections      sync.Map
+	invitations      sync.Map
+	controlPc        net.PacketConn
+	midiPc           net.PacketConn
+	handlerMutex     sync.RWMutex
+	midiHandler      MIDIHandler
+	endHandler       EndHandler
+	syncSchedule     SyncSchedule
+	peerTimeout      time.Duration
+	feedbackInterval time.Duration
+	enhancedChapterC bool
+	runningStatus    bool
+	transport        Transport
+	// invitationPolicies decide whether an invitation of a new remote participant is accepted.
+	invitationPolicies []InvitationPolicy
+	// maintenanceInterval is the interval of the maintenanceLoop.
+	maintenanceInterval time.Duration
+	// done is closed when the session is closed, loops waits for the go routines.
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	loops     sync.WaitGroup
 }
 
-// Start is starting a new session
-func Start(bonjourName string, port uint16) (s *MIDINetworkSession) {
+// MIDIHandler is called for every MIDI message received from a remote participant.
+// The Timestamp of the MIDICommands is converted to the local time.
+type MIDIHandler func(conn *MIDINetworkStream, mcs rtp.MIDICommands)
+
+// EndHandler is called when a MIDINetworkStream was removed from the session.
+// The reason is ErrEndedByRemote, ErrPeerTimeout or ErrSessionClosed.
+// The handler is called from its own go routine, so it may call Close.
+type EndHandler func(conn *MIDINetworkStream, reason error)
+
+// Reasons passed to the EndHandler
+var (
+	// ErrEndedByRemote is passed when the remote participant sent BY.
+	ErrEndedByRemote = errors.New("ended by remote participant")
+	// ErrPeerTimeout is passed when the remote participant stopped answering.
+	ErrPeerTimeout = errors.New("remote participant timed out")
+	// ErrSessionClosed is passed when the local session was closed.
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// Start is starting a new session listening on the control port and the MIDI
+// port (control port + 1). An error is returned if one of the ports can not be
+// opened or if the control port is 65535. The port 0 selects an ephemeral
+// control port, see WithTransport and WithPacketConns to open the ports differently.
+//
+// The session is closed when the context is done, see Close.
+func Start(ctx context.Context, bonjourName string, port uint16, opts ...Option) (*MIDINetworkSession, error) {
 	session := MIDINetworkSession{
-		BonjourName:    bonjourName,
-		SSRC:           rand.Uint32(),
-		Port:           port,
-		StartTime:      time.Now(),
-		SequenceNumber: uint16(rand.Int()),
+		BonjourName:         bonjourName,
+		SSRC:                rand.Uint32(),
+		Port:                port,
+		StartTime:           time.Now(),
+		SequenceNumber:      uint16(rand.Int()),
+		syncSchedule:        DefaultSyncSchedule,
+		peerTimeout:         DefaultPeerTimeout,
+		feedbackInterval:    DefaultReceiverFeedbackInterval,
+		maintenanceInterval: defaultMaintenanceInterval,
+		done:                make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&session)
+	}
+
+	switch {
+	case session.controlPc == nil && session.midiPc == nil:
+		if err := session.listen(); err != nil {
+			return nil, err
+		}
+	case session.controlPc == nil || session.midiPc == nil:
+		return nil, fmt.Errorf("%w: control %v, MIDI %v", ErrMissingPacketConn, session.controlPc, session.midiPc)
+	default:
+		if p := addrPort(session.controlPc.LocalAddr()); p != 0 {
+			session.Port = p
+		}
+	}
+
+	session.loops.Add(3)
+	go messageLoop(session.controlPc, &session)
+
+	go messageLoop(session.midiPc, &session)
+
+	go maintenanceLoop(&session)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-session.done:
+		}
+	}()
+
+	return &session, nil
+}
+
+// Errors returned by Invite
+var (
+	// ErrInvitationRejected is returned when the remote participant answers with NO.
+	ErrInvitationRejected = errors.New("invitation rejected")
+	// ErrInvitationTimeout is returned when the remote participant does not answer.
+	ErrInvitationTimeout = errors.New("invitation timeout")
+	// ErrAlreadyConnected is returned when a stream to the remote participant already exists.
+	ErrAlreadyConnected = errors.New("already connected")
+)
+
+// The invitation is retried in this interval. They are variables to shorten
+// the timeout in tests.
+var (
+	invitationRetryInterval = time.Second
+	invitationRetries       = 12
+)
+
+// pendingInvitation receives the responses to an invitation. The responses are
+// routed by the port on which they arrived, so a late response of the control
+// port can not complete the invitation of the MIDI port.
+type pendingInvitation struct {
+	control chan sip.ControlMessage
+	midi    chan sip.ControlMessage
+}
+
+// Invite a remote participant listening on the given control port address
+// into this session. The invitation is sent to the control port first and
+// then to the MIDI port (control port + 1). Once both ports accepted the
+// invitation, the clock synchronization is started.
+//
+// The invitation is retried until the remote participant answers, the retries
+// are exhausted or the context is done.
+func (s *MIDINetworkSession) Invite(ctx context.Context, addr *net.UDPAddr) (*MIDINetworkStream, error) {
+	token := rand.Uint32()
+	pending := &pendingInvitation{
+		control: make(chan sip.ControlMessage, 1),
+		midi:    make(chan sip.ControlMessage, 1),
+	}
+	s.invitations.Store(token, pending)
+	defer s.invitations.Delete(token)
+
+	invitation := sip.ControlMessage{
+		Cmd:   sip.Invitation,
+		Token: token,
+		SSRC:  s.SSRC,
+		Name:  s.BonjourName,
+	}
+
+	accepted, err := invite(ctx, invitation, addr, s.controlPc, pending.control)
+	if err != nil {
+		return nil, err
+	}
+
+	midiAddr := &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1, Zone: addr.Zone}
+	host := MIDINetworkHost{
+		ControlAddr: addr,
+		ControlPc:   s.controlPc,
+		MIDIAddr:    midiAddr,
+		MIDIPc:      s.midiPc,
+		BonjourName: accepted.Name,
+	}
+	conn := &MIDINetworkStream{
+		Session:    s,
+		Host:       host,
+		RemoteSSRC: accepted.SSRC,
+		State:      controlChannelEstablished,
+		initiator:  true,
+		journal:    s.newJournal(),
+		recovery:   recoveryjournal.NewReceiver(),
 	}
 
-	go messageLoop(port, &session)
+	if _, err = invite(ctx, invitation, midiAddr, s.midiPc, pending.midi); err != nil {
+		conn.sendConnectionEnd(addr, s.controlPc)
+		return nil, err
+	}
+
+	conn.State = ready
+	conn.lastSeen = time.Now()
+	if _, found := s.connections.LoadOrStore(conn.RemoteSSRC, conn); found {
+		conn.sendConnectionEnd(addr, s.controlPc)
+		return nil, fmt.Errorf("%w: SSRC [%x]", ErrAlreadyConnected, conn.RemoteSSRC)
+	}
+	log.Printf("Connection established to remote participant SSRC [%x]", conn.RemoteSSRC)
 
-	go messageLoop(port+1, &session)
+	conn.synchronize(time.Now())
 
-	return &session
+	return conn, nil
+}
+
+func invite(ctx context.Context, msg sip.ControlMessage, addr net.Addr, pc net.PacketConn, responses chan sip.ControlMessage) (sip.ControlMessage, error) {
+	ticker := time.NewTicker(invitationRetryInterval)
+	defer ticker.Stop()
+	for i := 0; i < invitationRetries; i++ {
+		sendControlMessage(msg, addr, pc)
+		select {
+		case <-ctx.Done():
+			return sip.ControlMessage{}, ctx.Err()
+		case response := <-responses:
+			if response.Cmd == sip.InvitationRejected {
+				return response, fmt.Errorf("%w: by %v", ErrInvitationRejected, addr)
+			}
+			return response, nil
+		case <-ticker.C:
+		}
+	}
+	return sip.ControlMessage{}, fmt.Errorf("%w: %v", ErrInvitationTimeout, addr)
 }
 
 // End is ending a session
@@ -49,43 +239,165 @@ func (s *MIDINetworkSession) End() {
 	})
 }
 
-// SendMIDIPayload sends the MIDI payload immediately to all MIDINetworkStreams
-func (s *MIDINetworkSession) SendMIDIPayload(payload []byte) {
+// Close ends and removes all streams, closes the control and the MIDI port and
+// waits until the go routines of the session exited. The EndHandler is called
+// with ErrSessionClosed for every stream. It is safe to call Close more than once,
+// but it must not be called from a MIDIHandler.
+func (s *MIDINetworkSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.connections.Range(func(k, v interface{}) bool {
+			conn := v.(*MIDINetworkStream)
+			conn.End()
+			s.removeConnection(conn, ErrSessionClosed)
+			return true
+		})
+		close(s.done)
+		for _, pc := range []net.PacketConn{s.controlPc, s.midiPc} {
+			if pc == nil {
+				continue
+			}
+			if err := pc.Close(); err != nil && s.closeErr == nil {
+				s.closeErr = err
+			}
+		}
+	})
+	s.loops.Wait()
+	return s.closeErr
+}
+
+// closed returns true once Close was called.
+func (s *MIDINetworkSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleMIDI registers the handler which is called for every received MIDI message.
+// The handler is called from the receiving go routine and should return quickly.
+func (s *MIDINetworkSession) HandleMIDI(handler MIDIHandler) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+	s.midiHandler = handler
+}
+
+// HandleEnd registers the handler which is called when a stream was removed
+// because the remote participant ended it, stopped answering or the session was closed.
+func (s *MIDINetworkSession) HandleEnd(handler EndHandler) {
+	s.handlerMutex.Lock()
+	defer s.handlerMutex.Unlock()
+	s.endHandler = handler
+}
+
+// SendMIDIPayload sends the MIDI payload immediately to all MIDINetworkStreams.
+//
+// The payload must be a single complete MIDI message, see midi.Parse.
+// Use a midi.Parser to split a raw MIDI byte stream into payloads.
+func (s *MIDINetworkSession) SendMIDIPayload(payload []byte) error {
+	if _, err := midi.Parse(payload); err != nil {
+		return err
+	}
 	mcs := rtp.MIDICommands{
 		Timestamp: time.Now(),
 		Commands:  []rtp.MIDICommand{{Payload: payload}},
 	}
-	s.SendMIDICommands(mcs)
+	return s.SendMIDICommands(mcs)
 }
 
-// SendMIDICommands sends the commands to all MIDINetworkStreams
-func (s *MIDINetworkSession) SendMIDICommands(mcs rtp.MIDICommands) {
-	s.SequenceNumber++
-	m := rtp.MIDIMessage{
-		SequenceNumber: s.SequenceNumber,
-		SSRC:           s.SSRC,
-		Commands:       mcs,
+// SendMIDICommands sends the commands to all MIDINetworkStreams.
+//
+// Commands which do not fit into a single message are sent in consecutive
+// messages, see rtp.MIDICommands.Split.
+func (s *MIDINetworkSession) SendMIDICommands(mcs rtp.MIDICommands) error {
+	mcs.RunningStatus = mcs.RunningStatus || s.runningStatus
+	lists, err := mcs.Split(s.StartTime)
+	if err != nil {
+		return err
 	}
-	s.connections.Range(func(k, v interface{}) bool {
-		v.(*MIDINetworkStream).SendMIDIMessage(m)
-		return true
-	})
+	for _, l := range lists {
+		s.SequenceNumber++
+		m := rtp.MIDIMessage{
+			SequenceNumber: s.SequenceNumber,
+			SSRC:           s.SSRC,
+			Commands:       l,
+		}
+		s.connections.Range(func(k, v interface{}) bool {
+			if err := v.(*MIDINetworkStream).SendMIDIMessage(m); err != nil {
+				fmt.Println(err)
+			}
+			return true
+		})
+	}
+	return nil
 }
 
-func messageLoop(port uint16, s *MIDINetworkSession) {
-	pc, mcErr := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
-	if mcErr != nil {
-		panic(mcErr)
+// ephemeralPortAttempts limits the ephemeral control ports which are tried
+// until the following port is free for the MIDI port.
+const ephemeralPortAttempts = 16
+
+// listen opens the control and the MIDI port with the transport. An ephemeral
+// control port is used if the port of the session is 0. Another ephemeral port
+// is tried if the following port can not be opened.
+func (s *MIDINetworkSession) listen() (err error) {
+	if s.transport == nil {
+		s.transport = UDPTransport{}
+	}
+	if s.Port != 0 {
+		return s.listenPair(s.Port)
+	}
+	for i := 0; i < ephemeralPortAttempts; i++ {
+		if err = s.listenPair(0); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// listenPair opens the control port and the following MIDI port.
+func (s *MIDINetworkSession) listenPair(port uint16) error {
+	if port == math.MaxUint16 {
+		return fmt.Errorf("%w: control port %d", ErrInvalidPort, port)
+	}
+	control, err := s.transport.ListenPacket(port)
+	if err != nil {
+		return fmt.Errorf("listen on port %d: %w", port, err)
 	}
-	defer pc.Close()
-	buffer := make([]byte, 1024)
+	if port == 0 {
+		port = addrPort(control.LocalAddr())
+	}
+	if port == math.MaxUint16 {
+		control.Close()
+		return fmt.Errorf("%w: control port %d", ErrInvalidPort, port)
+	}
+	midiPc, err := s.transport.ListenPacket(port + 1)
+	if err != nil {
+		control.Close()
+		return fmt.Errorf("listen on port %d: %w", port+1, err)
+	}
+	s.Port, s.controlPc, s.midiPc = port, control, midiPc
+	return nil
+}
+
+func messageLoop(pc net.PacketConn, s *MIDINetworkSession) {
+	defer s.loops.Done()
+	buffer := make([]byte, 65535)
 	for {
 		n, addr, err := pc.ReadFrom(buffer)
 		if err != nil {
+			if s.closed() {
+				return
+			}
 			fmt.Println(err)
 			continue
 		}
 
+		if !sip.IsControlMessage(buffer[:n]) {
+			s.handleMIDIMessage(buffer[:n])
+			continue
+		}
+
 		msg, err := sip.Decode(buffer[:n])
 		if err != nil {
 			fmt.Println(err)
@@ -94,33 +406,189 @@ func messageLoop(port uint16, s *MIDINetworkSession) {
 		}
 		log.Printf("-> incoming message: %v", msg)
 
-		conn, found := s.getConnection(msg)
-		if found {
-			conn.handleControl(msg, pc, addr)
-		}
+		s.handleControlMessage(msg, pc, addr)
 	}
 }
 
-func (s *MIDINetworkSession) getConnection(msg sip.ControlMessage) (c *MIDINetworkStream, found bool) {
-	if msg.Cmd == sip.Invitation {
+func (s *MIDINetworkSession) handleControlMessage(msg sip.ControlMessage, pc net.PacketConn, addr net.Addr) {
+	switch msg.Cmd {
+	case sip.InvitationAccepted, sip.InvitationRejected:
+		s.handleInvitationResponse(msg, pc)
+		return
+	case sip.Invitation:
+		s.handleInvitation(msg, pc, addr)
+		return
+	}
+	conn, found := s.getConnection(msg)
+	if found {
+		conn.seen()
+		conn.handleControl(msg, pc, addr)
+	}
+}
+
+// handleInvitation creates a new stream for an invitation received on the control
+// port and passes the invitation to the stream. Invitations received on the MIDI
+// port without a prior control handshake and invitations refused by the policies
+// are rejected.
+func (s *MIDINetworkSession) handleInvitation(msg sip.ControlMessage, pc net.PacketConn, addr net.Addr) {
+	conn, found := s.getConnection(msg)
+	if !found {
+		if s.isMIDIPort(pc) {
+			log.Printf("Rejecting invitation of SSRC [%x] on the MIDI port without control handshake", msg.SSRC)
+			sendInvitationRejected(msg, s.SSRC, addr, pc)
+			return
+		}
+		if err := s.admit(msg, addr); err != nil {
+			log.Printf("Rejecting invitation of SSRC [%x]: %v", msg.SSRC, err)
+			sendInvitationRejected(msg, s.SSRC, addr, pc)
+			return
+		}
 		log.Printf("New connection requested from remote participant SSRC [%x]", msg.SSRC)
-		conn, found := s.connections.LoadOrStore(msg.SSRC, s.createConnection(msg))
-		if found {
-			log.Printf("Connections was already established to SSRC [%x]", msg.SSRC)
+		conn = s.createConnection(msg)
+		s.connections.Store(msg.SSRC, conn)
+	}
+	conn.seen()
+	conn.handleInvitation(msg, pc, addr)
+}
+
+// admit returns the error of the first policy which refuses the invitation.
+func (s *MIDINetworkSession) admit(msg sip.ControlMessage, addr net.Addr) error {
+	for _, policy := range s.invitationPolicies {
+		if err := policy(msg, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MIDINetworkSession) connectionCount() (count int) {
+	s.connections.Range(func(k, v interface{}) bool {
+		count++
+		return true
+	})
+	return
+}
+
+func (s *MIDINetworkSession) isMIDIPort(pc net.PacketConn) bool {
+	return pc != nil && pc == s.midiPc
+}
+
+const defaultMaintenanceInterval = 100 * time.Millisecond
+
+// maintenanceLoop drives the clock synchronization of the streams initiated by
+// this session, sends the receiver feedback and removes streams of remote
+// participants which stopped answering.
+func maintenanceLoop(s *MIDINetworkSession) {
+	defer s.loops.Done()
+	ticker := time.NewTicker(s.maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-s.done:
+			return
+		case now = <-ticker.C:
 		}
-		return conn.(*MIDINetworkStream), true
+		s.maintain(now)
 	}
+}
+
+// maintain runs the maintenance of all streams at the given time.
+func (s *MIDINetworkSession) maintain(now time.Time) {
+	s.connections.Range(func(k, v interface{}) bool {
+		conn := v.(*MIDINetworkStream)
+		if conn.silentSince(now) > s.peerTimeout {
+			conn.End()
+			s.removeConnection(conn, ErrPeerTimeout)
+			return true
+		}
+		if conn.synchronizationDue(now) {
+			conn.synchronize(now)
+		}
+		if conn.receiverFeedbackDue(now) {
+			conn.sendReceiverFeedback(now)
+		}
+		return true
+	})
+}
+
+func (s *MIDINetworkSession) handleInvitationResponse(msg sip.ControlMessage, pc net.PacketConn) {
+	pending, found := s.invitations.Load(msg.Token)
+	if !found {
+		log.Printf("No pending invitation with token [%x]", msg.Token)
+		return
+	}
+	responses := pending.(*pendingInvitation).control
+	if s.isMIDIPort(pc) {
+		responses = pending.(*pendingInvitation).midi
+	}
+	select {
+	case responses <- msg:
+	default:
+		log.Printf("Ignoring duplicate response to invitation [%x]", msg.Token)
+	}
+}
+
+func (s *MIDINetworkSession) handleMIDIMessage(buffer []byte) {
+	msg, err := rtp.Decode(buffer)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println(hex.Dump(buffer))
+		return
+	}
+	log.Printf("-> incoming payload: %v", msg)
+
 	conn, found := s.connections.Load(msg.SSRC)
 	if !found {
 		log.Printf("Connection to SSRC [%x] not found", msg.SSRC)
+		return
+	}
+	conn.(*MIDINetworkStream).seen()
+	conn.(*MIDINetworkStream).handleMIDIMessage(msg)
+}
+
+func (s *MIDINetworkSession) deliverMIDI(conn *MIDINetworkStream, mcs rtp.MIDICommands) {
+	s.handlerMutex.RLock()
+	handler := s.midiHandler
+	s.handlerMutex.RUnlock()
+	if handler != nil {
+		handler(conn, mcs)
+	}
+}
+
+func (s *MIDINetworkSession) getConnection(msg sip.ControlMessage) (c *MIDINetworkStream, found bool) {
+	conn, found := s.connections.Load(msg.SSRC)
+	if !found {
+		if msg.Cmd != sip.Invitation {
+			log.Printf("Connection to SSRC [%x] not found", msg.SSRC)
+		}
 		return nil, false
 	}
 	return conn.(*MIDINetworkStream), found
 }
 
-func (s *MIDINetworkSession) removeConnection(conn *MIDINetworkStream) {
-	log.Printf("Connection ended by remote participant SSRC [%x]", conn.RemoteSSRC)
-	s.connections.Delete(conn.RemoteSSRC)
+// removeConnection removes the stream and calls the EndHandler. Nothing happens
+// if the stream was already removed, so the EndHandler is called only once.
+// The EndHandler is not called by the go routines of the session, because
+// Close waits for them.
+func (s *MIDINetworkSession) removeConnection(conn *MIDINetworkStream, reason error) {
+	if _, found := s.connections.LoadAndDelete(conn.RemoteSSRC); !found {
+		return
+	}
+	log.Printf("Connection to remote participant SSRC [%x] removed: %v", conn.RemoteSSRC, reason)
+
+	s.handlerMutex.RLock()
+	handler := s.endHandler
+	s.handlerMutex.RUnlock()
+	if handler != nil {
+		go handler(conn, reason)
+	}
+}
+
+func (s *MIDINetworkSession) newJournal() *recoveryjournal.Sender {
+	journal := recoveryjournal.NewSender()
+	journal.EnhancedChapterC = s.enhancedChapterC
+	return journal
 }
 
 func (s *MIDINetworkSession) createConnection(msg sip.ControlMessage) *MIDINetworkStream {
@@ -130,6 +598,9 @@ func (s *MIDINetworkSession) createConnection(msg sip.ControlMessage) *MIDINetwo
 		Host:       host,
 		RemoteSSRC: msg.SSRC,
 		State:      initial,
+		lastSeen:   time.Now(),
+		journal:    s.newJournal(),
+		recovery:   recoveryjournal.NewReceiver(),
 	}
 	return &conn
 }
@@ -0,0 +1,580 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/midi"
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/laenzlinger/go-midi-rtp/sip"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionTest runs a session on a MemoryNetwork together with the control and
+// the MIDI port of a remote participant on another host.
+type sessionTest struct {
+	t             *testing.T
+	s             *MIDINetworkSession
+	control, midi net.PacketConn
+}
+
+var (
+	localHost  = net.IPv4(10, 0, 0, 1)
+	remoteHost = net.IPv4(10, 0, 0, 2)
+)
+
+// newSessionTest starts the session with the given options. The test fails if
+// the session or the ports of the remote participant can not be opened.
+func newSessionTest(t *testing.T, opts ...Option) *sessionTest {
+	network := NewMemoryNetwork()
+	opts = append(opts, WithTransport(network.Transport(localHost)))
+	s, err := Start(context.Background(), "local", 5004, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &sessionTest{t: t, s: s}
+	remote := network.Transport(remoteHost)
+	if st.control, err = remote.ListenPacket(5004); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	if st.midi, err = remote.ListenPacket(5005); err != nil {
+		s.Close()
+		st.control.Close()
+		t.Fatal(err)
+	}
+	return st
+}
+
+// pausedMaintenance stops the maintenanceLoop from interfering with tests
+// which call maintain.
+func pausedMaintenance(s *MIDINetworkSession) {
+	s.maintenanceInterval = time.Hour
+}
+
+func (st *sessionTest) close() {
+	st.s.Close()
+	st.control.Close()
+	st.midi.Close()
+}
+
+// addr returns the control port address of the remote participant.
+func (st *sessionTest) addr() *net.UDPAddr {
+	return st.control.LocalAddr().(*net.UDPAddr)
+}
+
+// send passes the message from the port of the remote participant to the
+// corresponding port of the session.
+func (st *sessionTest) send(pc net.PacketConn, msg sip.ControlMessage) {
+	port := st.s.Port
+	if pc == st.midi {
+		port++
+	}
+	sendControlMessage(msg, &net.UDPAddr{IP: localHost, Port: int(port)}, pc)
+}
+
+// answer waits for an invitation on the port and sends the answers to the
+// corresponding port of the session.
+func (st *sessionTest) answer(pc net.PacketConn, answers ...sip.Command) {
+	buffer := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buffer)
+	if err != nil {
+		return
+	}
+	invitation, _ := sip.Decode(buffer[:n])
+	for _, cmd := range answers {
+		st.send(pc, sip.ControlMessage{Cmd: cmd, Token: invitation.Token, SSRC: 2, Name: "remote"})
+	}
+}
+
+// stream adds a ready stream of the remote participant with SSRC 2 to the session.
+func (st *sessionTest) stream() *MIDINetworkStream {
+	conn := st.s.createConnection(sip.ControlMessage{SSRC: 2})
+	conn.Host = MIDINetworkHost{
+		ControlAddr: st.control.LocalAddr(),
+		ControlPc:   st.s.controlPc,
+		MIDIAddr:    st.midi.LocalAddr(),
+		MIDIPc:      st.s.midiPc,
+	}
+	conn.State = ready
+	conn.seen()
+	st.s.connections.Store(conn.RemoteSSRC, conn)
+	return conn
+}
+
+func Test_invite_is_accepted_on_both_ports(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	go st.answer(st.control, sip.InvitationAccepted)
+	go st.answer(st.midi, sip.InvitationAccepted)
+	// when
+	conn, err := st.s.Invite(context.Background(), st.addr())
+	// then
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), conn.RemoteSSRC)
+	assert.Equal(t, "remote", conn.Host.BonjourName)
+	assert.Equal(t, ready, conn.State)
+	_, found := st.s.connections.Load(uint32(2))
+	assert.True(t, found)
+}
+
+func Test_invite_is_rejected_with_no(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	go st.answer(st.control, sip.InvitationRejected)
+	// when
+	_, err := st.s.Invite(context.Background(), st.addr())
+	// then
+	assert.True(t, errors.Is(err, ErrInvitationRejected))
+}
+
+func Test_late_control_response_does_not_complete_midi_invitation(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	go st.answer(st.control, sip.InvitationAccepted, sip.InvitationAccepted)
+	go st.answer(st.midi, sip.InvitationRejected)
+	// when
+	_, err := st.s.Invite(context.Background(), st.addr())
+	// then
+	assert.True(t, errors.Is(err, ErrInvitationRejected))
+	_, found := st.s.connections.Load(uint32(2))
+	assert.False(t, found)
+}
+
+func Test_invite_times_out_after_retries(t *testing.T) {
+	// given
+	defer func(interval time.Duration, retries int) {
+		invitationRetryInterval, invitationRetries = interval, retries
+	}(invitationRetryInterval, invitationRetries)
+	invitationRetryInterval, invitationRetries = 10*time.Millisecond, 3
+	st := newSessionTest(t)
+	defer st.close()
+	// when
+	_, err := st.s.Invite(context.Background(), st.addr())
+	// then
+	assert.True(t, errors.Is(err, ErrInvitationTimeout))
+	received := 0
+	for {
+		st.control.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, _, err := st.control.ReadFrom(make([]byte, 1024)); err != nil {
+			break
+		}
+		received++
+	}
+	assert.Equal(t, 3, received)
+}
+
+func Test_invite_is_cancelled_with_context(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// when
+	_, err := st.s.Invite(ctx, st.addr())
+	// then
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+// newMaintenanceTest has a stream initiated to the remote participant. The
+// maintenance runs only when the test calls maintain.
+func newMaintenanceTest(t *testing.T, schedule SyncSchedule, timeout time.Duration) (*sessionTest, *MIDINetworkStream) {
+	st := newSessionTest(t, WithSyncSchedule(schedule), WithPeerTimeout(timeout), pausedMaintenance)
+	conn := st.stream()
+	conn.initiator = true
+	return st, conn
+}
+
+// endReasons registers an EndHandler which passes the reasons to the returned channel.
+func endReasons(s *MIDINetworkSession, conn *MIDINetworkStream) chan error {
+	reasons := make(chan error, 10)
+	s.HandleEnd(func(c *MIDINetworkStream, reason error) {
+		if c == conn {
+			reasons <- reason
+		}
+	})
+	return reasons
+}
+
+// ended returns the reasons passed to the EndHandler until it is not called anymore.
+func ended(reasons chan error) (errs []error) {
+	for {
+		select {
+		case reason := <-reasons:
+			errs = append(errs, reason)
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// received returns the commands of the control messages received on the port.
+func received(pc net.PacketConn) (cmds []sip.Command) {
+	buffer := make([]byte, 1024)
+	for {
+		pc.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		n, _, err := pc.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		msg, _ := sip.Decode(buffer[:n])
+		cmds = append(cmds, msg.Cmd)
+	}
+}
+
+func Test_maintenance_repeats_synchronization(t *testing.T) {
+	// given
+	schedule := SyncSchedule{BurstCount: 2, BurstInterval: time.Second, Interval: 10 * time.Second}
+	st, conn := newMaintenanceTest(t, schedule, time.Minute)
+	defer st.close()
+	now := time.Now()
+	// when
+	st.s.maintain(now)
+	first := received(st.midi)
+	st.s.maintain(now.Add(500 * time.Millisecond))
+	early := received(st.midi)
+	st.s.maintain(now.Add(time.Second))
+	burst := received(st.midi)
+	st.s.maintain(now.Add(5 * time.Second))
+	afterBurst := received(st.midi)
+	st.s.maintain(now.Add(11 * time.Second))
+	interval := received(st.midi)
+	// then
+	assert.Equal(t, []sip.Command{sip.Synchronization}, first)
+	assert.Empty(t, early)
+	assert.Equal(t, []sip.Command{sip.Synchronization}, burst)
+	assert.Empty(t, afterBurst)
+	assert.Equal(t, []sip.Command{sip.Synchronization}, interval)
+	assert.Equal(t, 3, conn.syncCount)
+}
+
+func Test_maintenance_ends_silent_peer(t *testing.T) {
+	// given
+	st, conn := newMaintenanceTest(t, DefaultSyncSchedule, time.Minute)
+	defer st.close()
+	reasons := endReasons(st.s, conn)
+	conn.seen()
+	now := time.Now()
+	// when
+	st.s.maintain(now.Add(30 * time.Second))
+	_, alive := st.s.connections.Load(uint32(2))
+	st.s.maintain(now.Add(61 * time.Second))
+	// then
+	assert.True(t, alive)
+	assert.Equal(t, []sip.Command{sip.End}, received(st.control))
+	assert.Equal(t, []error{ErrPeerTimeout}, ended(reasons))
+	_, found := st.s.connections.Load(uint32(2))
+	assert.False(t, found)
+}
+
+func Test_end_handler_is_called_once(t *testing.T) {
+	// given
+	st, conn := newMaintenanceTest(t, DefaultSyncSchedule, time.Minute)
+	defer st.close()
+	reasons := endReasons(st.s, conn)
+	// when
+	conn.handleEnd()
+	st.s.removeConnection(conn, ErrPeerTimeout)
+	// then
+	assert.Equal(t, []error{ErrEndedByRemote}, ended(reasons))
+}
+
+func Test_receiver_feedback_is_sent_to_the_control_port(t *testing.T) {
+	// given
+	st, conn := newMaintenanceTest(t, DefaultSyncSchedule, time.Minute)
+	defer st.close()
+	conn.receive(0x1234)
+	// when
+	conn.sendReceiverFeedback(time.Now())
+	// then
+	buffer := make([]byte, 1024)
+	st.control.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := st.control.ReadFrom(buffer)
+	assert.Nil(t, err)
+	rs, err := sip.Decode(buffer[:n])
+	assert.Nil(t, err)
+	assert.Equal(t, sip.ReceiverFeedback, rs.Cmd)
+	assert.Equal(t, st.s.SSRC, rs.SSRC)
+	assert.Equal(t, uint32(0x12340000), rs.SequenceNumber)
+	assert.Empty(t, received(st.midi))
+}
+
+func Test_long_commands_are_sent_in_consecutive_messages(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	st.stream()
+	st.s.SequenceNumber = 10
+	sysex := make([]byte, 2000)
+	sysex[0], sysex[len(sysex)-1] = 0xf0, 0xf7
+	// when
+	err := st.s.SendMIDICommands(rtp.MIDICommands{
+		Timestamp: time.Now(),
+		Commands: []rtp.MIDICommand{
+			{Payload: sysex},
+			{Payload: sysex},
+			{Payload: sysex},
+		},
+	})
+	// then
+	assert.Nil(t, err)
+	buffer := make([]byte, 65535)
+	for _, expected := range []struct {
+		seqNum   uint16
+		commands int
+	}{{11, 2}, {12, 1}} {
+		st.midi.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, rErr := st.midi.ReadFrom(buffer)
+		assert.Nil(t, rErr)
+		msg, dErr := rtp.Decode(buffer[:n])
+		assert.Nil(t, dErr)
+		assert.Equal(t, expected.seqNum, msg.SequenceNumber)
+		assert.Len(t, msg.Commands.Commands, expected.commands)
+	}
+}
+
+func Test_segmented_sysex_is_delivered_complete(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	conn := st.stream()
+	delivered := []rtp.MIDICommands{}
+	st.s.HandleMIDI(func(conn *MIDINetworkStream, mcs rtp.MIDICommands) {
+		delivered = append(delivered, mcs)
+	})
+	// when
+	conn.handleMIDIMessage(rtp.MIDIMessage{SequenceNumber: 1, Commands: rtp.MIDICommands{
+		Commands: []rtp.MIDICommand{{Payload: []byte{0xf0, 0x01, 0xf0}}},
+	}})
+	conn.handleMIDIMessage(rtp.MIDIMessage{SequenceNumber: 2, Commands: rtp.MIDICommands{
+		Commands: []rtp.MIDICommand{{Payload: []byte{0xf7, 0x02, 0xf7}}},
+	}})
+	// then
+	assert.Len(t, delivered, 1)
+	assert.Equal(t, []rtp.MIDICommand{{Payload: []byte{0xf0, 0x01, 0x02, 0xf7}}}, delivered[0].Commands)
+}
+
+func Test_invalid_payload_is_not_sent(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	st.s.SequenceNumber = 10
+	// when
+	err := st.s.SendMIDIPayload([]byte{0x90, 0x3c})
+	// then
+	assert.True(t, errors.Is(err, midi.ErrInvalidLength))
+	assert.Equal(t, uint16(10), st.s.SequenceNumber)
+}
+
+// invite sends the invitation from the port of the remote participant and
+// returns the answer of the session.
+func (st *sessionTest) invite(pc net.PacketConn, token uint32) sip.Command {
+	st.send(pc, sip.ControlMessage{Cmd: sip.Invitation, Token: token, SSRC: 2, Name: "remote"})
+	buffer := make([]byte, 1024)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buffer)
+	if err != nil {
+		return 0
+	}
+	answer, _ := sip.Decode(buffer[:n])
+	return answer.Cmd
+}
+
+// state returns the state of the stream of the remote participant.
+func (st *sessionTest) state() (state, bool) {
+	conn, found := st.s.connections.Load(uint32(2))
+	if !found {
+		return initial, false
+	}
+	return conn.(*MIDINetworkStream).state(), true
+}
+
+func Test_invitation_on_control_and_midi_port_is_accepted(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	// when
+	control := st.invite(st.control, 7)
+	established, _ := st.state()
+	midiPort := st.invite(st.midi, 7)
+	actual, _ := st.state()
+	// then
+	assert.Equal(t, sip.InvitationAccepted, control)
+	assert.Equal(t, controlChannelEstablished, established)
+	assert.Equal(t, sip.InvitationAccepted, midiPort)
+	assert.Equal(t, ready, actual)
+}
+
+func Test_invitation_on_midi_port_without_control_handshake_is_rejected(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	// when
+	answer := st.invite(st.midi, 7)
+	// then
+	assert.Equal(t, sip.InvitationRejected, answer)
+	_, found := st.state()
+	assert.False(t, found)
+}
+
+func Test_invitation_for_ready_stream_is_rejected(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	st.invite(st.control, 7)
+	st.invite(st.midi, 7)
+	// when
+	control := st.invite(st.control, 8)
+	midiPort := st.invite(st.midi, 8)
+	// then
+	assert.Equal(t, sip.InvitationRejected, control)
+	assert.Equal(t, sip.InvitationRejected, midiPort)
+	actual, _ := st.state()
+	assert.Equal(t, ready, actual)
+}
+
+func Test_retransmitted_invitation_is_accepted_again(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	st.invite(st.control, 7)
+	// when
+	retransmitted := st.invite(st.control, 7)
+	other := st.invite(st.control, 8)
+	midiPort := st.invite(st.midi, 7)
+	retransmittedMIDI := st.invite(st.midi, 7)
+	// then
+	assert.Equal(t, sip.InvitationAccepted, retransmitted)
+	assert.Equal(t, sip.InvitationRejected, other)
+	assert.Equal(t, sip.InvitationAccepted, midiPort)
+	assert.Equal(t, sip.InvitationAccepted, retransmittedMIDI)
+	actual, _ := st.state()
+	assert.Equal(t, ready, actual)
+}
+
+func Test_invitation_refused_by_policy_is_rejected(t *testing.T) {
+	// given
+	refused := errors.New("visitor")
+	st := newSessionTest(t, WithInvitationPolicy(func(msg sip.ControlMessage, addr net.Addr) error {
+		if msg.Name == "remote" {
+			return refused
+		}
+		return nil
+	}))
+	defer st.close()
+	// when
+	answer := st.invite(st.control, 7)
+	// then
+	assert.Equal(t, sip.InvitationRejected, answer)
+	_, found := st.state()
+	assert.False(t, found)
+	assert.Equal(t, refused, st.s.admit(sip.ControlMessage{Name: "remote"}, nil))
+}
+
+// freePort returns a UDP port which is free together with the following port.
+func freePort(t *testing.T) uint16 {
+	for {
+		control, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := control.LocalAddr().(*net.UDPAddr).Port
+		midiPc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port+1))
+		control.Close()
+		if err == nil {
+			midiPc.Close()
+			return uint16(port)
+		}
+	}
+}
+
+func Test_session_can_be_started_again_after_close(t *testing.T) {
+	// given
+	port := freePort(t)
+	s, err := Start(context.Background(), "test", port)
+	assert.Nil(t, err)
+	// when
+	first := s.Close()
+	second := s.Close()
+	again, err := Start(context.Background(), "test", port)
+	// then
+	assert.Nil(t, first)
+	assert.Nil(t, second)
+	assert.Nil(t, err)
+	assert.Nil(t, again.Close())
+}
+
+func Test_start_fails_if_port_is_in_use(t *testing.T) {
+	// given
+	port := freePort(t)
+	midiPc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer midiPc.Close()
+	// when
+	_, err = Start(context.Background(), "test", port)
+	// then
+	assert.NotNil(t, err)
+	control, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	assert.Nil(t, err, "control port not released")
+	control.Close()
+}
+
+func Test_session_is_closed_when_context_is_done(t *testing.T) {
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := Start(ctx, "test", freePort(t))
+	assert.Nil(t, err)
+	// when
+	cancel()
+	// then
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "session not closed")
+	}
+	assert.Nil(t, s.Close())
+}
+
+func Test_close_removes_streams(t *testing.T) {
+	// given
+	st, conn := newMaintenanceTest(t, DefaultSyncSchedule, time.Minute)
+	defer st.close()
+	reasons := endReasons(st.s, conn)
+	// when
+	st.s.Close()
+	st.s.Close()
+	// then
+	assert.Equal(t, []sip.Command{sip.End}, received(st.control))
+	assert.Equal(t, []error{ErrSessionClosed}, ended(reasons))
+	_, found := st.s.connections.Load(uint32(2))
+	assert.False(t, found)
+}
+
+func Test_end_handler_may_close_the_session(t *testing.T) {
+	// given
+	st := newSessionTest(t)
+	defer st.close()
+	st.stream()
+	closed := make(chan error)
+	st.s.HandleEnd(func(c *MIDINetworkStream, reason error) {
+		closed <- st.s.Close()
+	})
+	// when
+	st.send(st.control, sip.ControlMessage{Cmd: sip.End, SSRC: 2})
+	// then
+	select {
+	case err := <-closed:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "session not closed")
+	}
+}
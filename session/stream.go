@@ -1,17 +1,26 @@
 package session
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/laenzlinger/go-midi-rtp/rtp/recoveryjournal"
 	"github.com/laenzlinger/go-midi-rtp/sip"
 	"github.com/laenzlinger/go-midi-rtp/timestamp"
 )
 
 type state uint8
 
+// The states of a stream. A stream of an invited remote participant moves from
+// initial to controlChannelEstablished when the invitation on the control port was
+// accepted and to ready when the invitation on the MIDI port was accepted.
+// All other invitations are rejected with NO, except the retransmissions of the
+// accepted invitation which are answered with OK again.
 const (
 	initial state = iota
 	controlChannelEstablished
@@ -36,25 +45,198 @@ type MIDINetworkStream struct {
 	Host       MIDINetworkHost
 	RemoteSSRC uint32
 	State      state
+	// stateMutex protects the State and the Host while the invitation is handled
+	// by the go routines receiving on the control and the MIDI port.
+	stateMutex sync.RWMutex
+	// initiator is true if the local session invited the remote participant.
+	initiator bool
+	// token of the accepted invitation of the remote participant.
+	token uint32
+	// clockMutex protects the clock estimate and the remoteStart.
+	clockMutex sync.RWMutex
+	// remoteStart is the local time at which the remote session clock was zero.
+	remoteStart time.Time
+	clock       clockEstimate
+	// livenessMutex protects the fields used to drive synchronization and timeouts.
+	livenessMutex sync.Mutex
+	lastSeen      time.Time
+	syncCount     int
+	nextSync      time.Time
+	// journalMutex protects the recovery journal of the sent messages.
+	journalMutex sync.Mutex
+	journal      *recoveryjournal.Sender
+	// recovery and sysEx are only used by the go routine receiving on the MIDI port.
+	recovery *recoveryjournal.Receiver
+	sysEx    rtp.SysExAssembler
+	// feedbackMutex protects the state of the received messages.
+	feedbackMutex   sync.Mutex
+	received        bool
+	receivedSeqNum  uint32 // highest extended sequence number received
+	feedbackPending bool
+	nextFeedback    time.Time
+}
+
+// ClockOffset returns the estimated offset of the remote session clock relative
+// to the local session clock. The offset is zero until the first synchronization completed.
+func (conn *MIDINetworkStream) ClockOffset() time.Duration {
+	conn.clockMutex.RLock()
+	defer conn.clockMutex.RUnlock()
+	return conn.clockOffset()
+}
+
+func (conn *MIDINetworkStream) clockOffset() time.Duration {
+	if conn.initiator {
+		return ticks(conn.clock.offset)
+	}
+	return ticks(-conn.clock.offset)
+}
+
+// Latency returns the estimated round trip time to the remote participant.
+func (conn *MIDINetworkStream) Latency() time.Duration {
+	conn.clockMutex.RLock()
+	defer conn.clockMutex.RUnlock()
+	return ticks(conn.clock.latency)
+}
+
+func (conn *MIDINetworkStream) updateClock(ts []uint64) {
+	conn.clockMutex.Lock()
+	conn.clock.update(ts[0], ts[1], ts[2])
+	conn.clockMutex.Unlock()
+	log.Printf("Clock offset to SSRC [%x] is %v, latency %v", conn.RemoteSSRC, conn.ClockOffset(), conn.Latency())
 }
 
 // End the session
 func (conn *MIDINetworkStream) End() {
-	log.Println("Ending connedtion")
-	conn.sendConnectionEnd(conn.Host.ControlAddr, conn.Host.ControlPc)
+	log.Println("Ending connection")
+	conn.stateMutex.RLock()
+	addr, pc := conn.Host.ControlAddr, conn.Host.ControlPc
+	conn.stateMutex.RUnlock()
+	if pc == nil {
+		return
+	}
+	conn.sendConnectionEnd(addr, pc)
 }
 
 // SendMIDIMessage sends to given MIDIMessage over the RTP-MIDI data port.
-func (conn *MIDINetworkStream) SendMIDIMessage(msg rtp.MIDIMessage) {
-	buff := rtp.Encode(msg, conn.Session.StartTime)
+// The recovery journal of the stream is appended to the message.
+// An error is returned if the message can not be encoded, see rtp.Encode.
+// Nothing is sent before the stream is ready.
+func (conn *MIDINetworkStream) SendMIDIMessage(msg rtp.MIDIMessage) error {
+	if conn.state() != ready {
+		return nil
+	}
+	conn.journalMutex.Lock()
+	j := conn.journal.Journal(msg)
+	b := new(bytes.Buffer)
+	if err := j.Encode(b); err != nil {
+		fmt.Println(err)
+	} else {
+		msg.Journal = b.Bytes()
+	}
+	buff, err := rtp.Encode(msg, conn.Session.StartTime)
+	if err != nil {
+		conn.journalMutex.Unlock()
+		return err
+	}
+	conn.journal.Record(msg)
+	conn.journalMutex.Unlock()
 
-	_, err := conn.Host.MIDIPc.WriteTo(buff, conn.Host.MIDIAddr)
+	_, err = conn.Host.MIDIPc.WriteTo(buff, conn.Host.MIDIAddr)
 	if err != nil {
 		fmt.Println(err)
-		return
+		return nil
 	}
 
 	log.Printf("<- outgoing payload: %v", msg)
+	return nil
+}
+
+func (conn *MIDINetworkStream) handleMIDIMessage(msg rtp.MIDIMessage) {
+	if conn.state() != ready {
+		log.Printf("Ignoring payload from SSRC [%x] before the session is established", msg.SSRC)
+		return
+	}
+	if conn.receive(msg.SequenceNumber) {
+		conn.sendReceiverFeedback(time.Now())
+	}
+	repair, err := conn.recovery.Receive(msg)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if len(repair) > 0 {
+		log.Printf("Recovered %d commands from the journal of SSRC [%x]", len(repair), msg.SSRC)
+		msg.Commands.Commands = append(repair, msg.Commands.Commands...)
+	}
+	commands := len(msg.Commands.Commands)
+	msg.Commands = conn.sysEx.Assemble(msg.Commands)
+	if commands > 0 && len(msg.Commands.Commands) == 0 {
+		// the message only contains incomplete SysEx segments
+		return
+	}
+	msg.Commands.Timestamp = conn.localTime(msg.Timestamp)
+	conn.Session.deliverMIDI(conn, msg.Commands)
+}
+
+// receive records the sequence number of a received message and
+// returns true if a loss was detected.
+func (conn *MIDINetworkStream) receive(seqNum uint16) (loss bool) {
+	conn.feedbackMutex.Lock()
+	defer conn.feedbackMutex.Unlock()
+	extended := uint32(seqNum)
+	if conn.received {
+		extended = conn.receivedSeqNum + uint32(int32(int16(seqNum-uint16(conn.receivedSeqNum))))
+		if int32(extended-conn.receivedSeqNum) <= 0 {
+			return false
+		}
+		loss = extended != conn.receivedSeqNum+1
+	}
+	conn.received = true
+	conn.receivedSeqNum = extended
+	conn.feedbackPending = true
+	return
+}
+
+// receiverFeedbackDue returns true if new messages were received since the last feedback
+// and the feedback interval elapsed.
+func (conn *MIDINetworkStream) receiverFeedbackDue(now time.Time) bool {
+	conn.feedbackMutex.Lock()
+	defer conn.feedbackMutex.Unlock()
+	return conn.feedbackPending && !now.Before(conn.nextFeedback)
+}
+
+// sendReceiverFeedback reports the highest received sequence number to the sender.
+// Like the Apple MIDI Network Driver, the 16 bit sequence number is sent in the
+// upper half of the sequence number field.
+func (conn *MIDINetworkStream) sendReceiverFeedback(now time.Time) {
+	conn.feedbackMutex.Lock()
+	conn.feedbackPending = false
+	conn.nextFeedback = now.Add(conn.Session.feedbackInterval)
+	seqNum := uint16(conn.receivedSeqNum)
+	conn.feedbackMutex.Unlock()
+
+	rs := sip.ControlMessage{
+		Cmd:            sip.ReceiverFeedback,
+		SSRC:           conn.Session.SSRC,
+		SequenceNumber: uint32(seqNum) << 16,
+	}
+	conn.sendControlMessage(rs, conn.Host.ControlAddr, conn.Host.ControlPc)
+}
+
+// localTime converts the RTP timestamp of the remote participant to the local time.
+// The clock offset is used once the clocks are synchronized, until then the remote
+// clock is anchored at the arrival of the first message.
+func (conn *MIDINetworkStream) localTime(ts uint32) time.Time {
+	now := time.Now()
+	conn.clockMutex.Lock()
+	if conn.clock.synchronized() {
+		conn.remoteStart = conn.Session.StartTime.Add(-conn.clockOffset())
+	}
+	if conn.remoteStart.IsZero() {
+		conn.remoteStart = now.Add(-timestamp.Timestamp(ts).Duration())
+	}
+	remoteStart := conn.remoteStart
+	conn.clockMutex.Unlock()
+	return timestamp.Extend(ts, timestamp.Of(now, remoteStart)).Time(remoteStart)
 }
 
 // HandleControl a sipControlMessage
@@ -66,28 +248,91 @@ func (conn *MIDINetworkStream) handleControl(msg sip.ControlMessage, pc net.Pack
 		conn.handleEnd()
 	case sip.Synchronization:
 		conn.handleSynchonization(msg, pc, addr)
+	case sip.ReceiverFeedback:
+		conn.handleReceiverFeedback(msg)
 	}
 }
 
+// handleReceiverFeedback moves the checkpoint of the recovery journal.
+// The Apple MIDI Network Driver sends the 16 bit sequence number in the
+// upper half of the sequence number field.
+func (conn *MIDINetworkStream) handleReceiverFeedback(msg sip.ControlMessage) {
+	conn.journalMutex.Lock()
+	defer conn.journalMutex.Unlock()
+	conn.journal.Acknowledge(uint16(msg.SequenceNumber >> 16))
+}
+
 func (conn *MIDINetworkStream) handleInvitation(msg sip.ControlMessage, pc net.PacketConn, addr net.Addr) {
-	switch conn.State {
-	case initial:
+	conn.stateMutex.Lock()
+	defer conn.stateMutex.Unlock()
+	midiPort := conn.Session.isMIDIPort(pc)
+	retransmission := !conn.initiator && msg.Token == conn.token
+	switch {
+	case conn.State == initial && !midiPort:
 		conn.Host.ControlAddr = addr
 		conn.Host.ControlPc = pc
+		conn.token = msg.Token
 		conn.sendInvitationAccepted(msg, addr, pc)
 		conn.State = controlChannelEstablished
-	case controlChannelEstablished:
+	case conn.State == controlChannelEstablished && midiPort && retransmission:
 		conn.Host.MIDIAddr = addr
 		conn.Host.MIDIPc = pc
 		conn.sendInvitationAccepted(msg, addr, pc)
 		conn.State = ready
-	case ready:
-		// FIXME send NO to control port
+	case conn.State == controlChannelEstablished && !midiPort && retransmission,
+		conn.State == ready && midiPort && retransmission:
+		// the remote participant did not receive our OK
+		conn.sendInvitationAccepted(msg, addr, pc)
+	default:
+		log.Printf("Rejecting invitation of SSRC [%x] in state %d", msg.SSRC, conn.State)
+		conn.sendInvitationRejected(msg, addr, pc)
 	}
 }
 
+// state returns the State of the stream.
+func (conn *MIDINetworkStream) state() state {
+	conn.stateMutex.RLock()
+	defer conn.stateMutex.RUnlock()
+	return conn.State
+}
+
 func (conn *MIDINetworkStream) handleEnd() {
-	conn.Session.removeConnection(conn)
+	conn.Session.removeConnection(conn, ErrEndedByRemote)
+}
+
+// seen records that a message was received from the remote participant.
+func (conn *MIDINetworkStream) seen() {
+	conn.livenessMutex.Lock()
+	defer conn.livenessMutex.Unlock()
+	conn.lastSeen = time.Now()
+}
+
+// silentSince returns the time since the last message of the remote participant.
+func (conn *MIDINetworkStream) silentSince(now time.Time) time.Duration {
+	conn.livenessMutex.Lock()
+	defer conn.livenessMutex.Unlock()
+	return now.Sub(conn.lastSeen)
+}
+
+// synchronizationDue returns true if the initiator has to start the next synchronization.
+func (conn *MIDINetworkStream) synchronizationDue(now time.Time) bool {
+	conn.livenessMutex.Lock()
+	defer conn.livenessMutex.Unlock()
+	return conn.initiator && conn.state() == ready && !now.Before(conn.nextSync)
+}
+
+// synchronize sends CK0 and schedules the next synchronization.
+func (conn *MIDINetworkStream) synchronize(now time.Time) {
+	schedule := conn.Session.syncSchedule
+	conn.livenessMutex.Lock()
+	conn.syncCount++
+	if conn.syncCount < schedule.BurstCount {
+		conn.nextSync = now.Add(schedule.BurstInterval)
+	} else {
+		conn.nextSync = now.Add(schedule.Interval)
+	}
+	conn.livenessMutex.Unlock()
+	conn.sendSynchronization()
 }
 
 func (conn *MIDINetworkStream) sendConnectionEnd(addr net.Addr, pc net.PacketConn) {
@@ -112,8 +357,22 @@ func (conn *MIDINetworkStream) sendInvitationAccepted(msg sip.ControlMessage, ad
 	conn.sendControlMessage(accept, addr, pc)
 }
 
+func (conn *MIDINetworkStream) sendInvitationRejected(msg sip.ControlMessage, addr net.Addr, pc net.PacketConn) {
+	sendInvitationRejected(msg, conn.Session.SSRC, addr, pc)
+}
+
+func sendInvitationRejected(msg sip.ControlMessage, ssrc uint32, addr net.Addr, pc net.PacketConn) {
+	reject := sip.ControlMessage{
+		Cmd:   sip.InvitationRejected,
+		Token: msg.Token,
+		SSRC:  ssrc,
+	}
+
+	sendControlMessage(reject, addr, pc)
+}
+
 func (conn *MIDINetworkStream) handleSynchonization(msg sip.ControlMessage, pc net.PacketConn, addr net.Addr) {
-	if conn.State == ready {
+	if conn.state() == ready {
 		switch len(msg.Timestamps) {
 		case 1:
 			fallthrough
@@ -127,13 +386,30 @@ func (conn *MIDINetworkStream) handleSynchonization(msg sip.ControlMessage, pc n
 				Timestamps: newTs,
 			}
 			conn.sendControlMessage(sync, addr, pc)
+			if len(newTs) == 3 {
+				conn.updateClock(newTs)
+			}
 		case 3:
-			// FIXME calculate offset_estimate = ((timestamp3 + timestamp1) / 2) - timestamp2
+			conn.updateClock(msg.Timestamps)
 		}
 	}
 }
 
+// sendSynchronization starts a clock synchronization by sending CK0 to the MIDI port.
+func (conn *MIDINetworkStream) sendSynchronization() {
+	sync := sip.ControlMessage{
+		Cmd:        sip.Synchronization,
+		SSRC:       conn.Session.SSRC,
+		Timestamps: []uint64{timestamp.Now(conn.Session.StartTime).Uint64()},
+	}
+	conn.sendControlMessage(sync, conn.Host.MIDIAddr, conn.Host.MIDIPc)
+}
+
 func (conn *MIDINetworkStream) sendControlMessage(msg sip.ControlMessage, addr net.Addr, pc net.PacketConn) {
+	sendControlMessage(msg, addr, pc)
+}
+
+func sendControlMessage(msg sip.ControlMessage, addr net.Addr, pc net.PacketConn) {
 	buff, err := sip.Encode(msg)
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,158 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/laenzlinger/go-midi-rtp/rtp"
+	"github.com/stretchr/testify/assert"
+)
+
+// timestampTest has a ready stream which delivers the received messages.
+type timestampTest struct {
+	*sessionTest
+	conn        *MIDINetworkStream
+	remoteStart time.Time
+	delivered   []rtp.MIDICommands
+}
+
+func newTimestampTest(t *testing.T) *timestampTest {
+	tt := &timestampTest{
+		sessionTest: newSessionTest(t),
+		remoteStart: time.Now().Add(-time.Hour),
+	}
+	tt.conn = tt.stream()
+	tt.s.HandleMIDI(func(conn *MIDINetworkStream, mcs rtp.MIDICommands) {
+		tt.delivered = append(tt.delivered, mcs)
+	})
+	return tt
+}
+
+// receive passes a message sent at the given remote session time to the session.
+func (tt *timestampTest) receive(at time.Duration, deltas ...time.Duration) {
+	mcs := rtp.MIDICommands{Timestamp: tt.remoteStart.Add(at)}
+	for _, delta := range deltas {
+		mcs.Commands = append(mcs.Commands, rtp.MIDICommand{DeltaTime: delta, Payload: []byte{0x90, 0x3c, 0x40}})
+	}
+	buffer, err := rtp.Encode(rtp.MIDIMessage{SSRC: 2, Commands: mcs}, tt.remoteStart)
+	if err != nil {
+		tt.t.Fatal(err)
+	}
+	tt.s.handleMIDIMessage(buffer)
+}
+
+func Test_first_received_message_is_anchored_at_arrival(t *testing.T) {
+	// given
+	tt := newTimestampTest(t)
+	defer tt.close()
+	// when
+	before := time.Now()
+	tt.receive(time.Minute, 0)
+	after := time.Now()
+	// then
+	assert.Len(t, tt.delivered, 1)
+	assert.False(t, tt.delivered[0].Timestamp.Before(before))
+	assert.False(t, tt.delivered[0].Timestamp.After(after))
+}
+
+func Test_received_timestamps_are_relative_to_the_first_message(t *testing.T) {
+	// given
+	tt := newTimestampTest(t)
+	defer tt.close()
+	tt.receive(time.Minute, 0)
+	// when
+	tt.receive(time.Minute+1500*time.Millisecond, 0, 10*time.Millisecond)
+	tt.receive(time.Minute-200*time.Millisecond, 0)
+	// then
+	first := tt.delivered[0].Timestamp
+	assert.Equal(t, 1500*time.Millisecond, tt.delivered[1].Timestamp.Sub(first))
+	times := tt.delivered[1].Times()
+	assert.Equal(t, 1500*time.Millisecond, times[0].Sub(first))
+	assert.Equal(t, 1510*time.Millisecond, times[1].Sub(first))
+	assert.Equal(t, -200*time.Millisecond, tt.delivered[2].Timestamp.Sub(first))
+}
+
+func Test_received_timestamps_use_the_clock_offset_after_synchronization(t *testing.T) {
+	// given
+	tt := newTimestampTest(t)
+	defer tt.close()
+	tt.conn.initiator = true
+	tt.receive(time.Minute, 0)
+	// when
+	tt.conn.updateClock([]uint64{1000, 51000, 1100})
+	tt.receive(time.Minute, 0, 10*time.Millisecond)
+	// then
+	offset := 4995 * time.Millisecond
+	assert.Equal(t, offset, tt.conn.ClockOffset())
+	assert.Equal(t, time.Minute-offset, tt.delivered[1].Timestamp.Sub(tt.s.StartTime))
+	assert.Equal(t, time.Minute-offset+10*time.Millisecond, tt.delivered[1].Times()[1].Sub(tt.s.StartTime))
+}
+
+func Test_received_timestamps_of_the_responder_use_the_inverse_clock_offset(t *testing.T) {
+	// given
+	tt := newTimestampTest(t)
+	defer tt.close()
+	// when
+	tt.conn.updateClock([]uint64{1000, 51000, 1100})
+	tt.receive(time.Minute, 0)
+	// then
+	offset := -4995 * time.Millisecond
+	assert.Equal(t, offset, tt.conn.ClockOffset())
+	assert.Equal(t, time.Minute-offset, tt.delivered[0].Timestamp.Sub(tt.s.StartTime))
+}
+
+func Test_local_time_is_safe_for_concurrent_use(t *testing.T) {
+	// given
+	conn := MIDINetworkStream{Session: &MIDINetworkSession{StartTime: time.Now()}}
+	done := make(chan time.Time)
+	// when
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- conn.localTime(1000)
+		}()
+	}
+	conn.updateClock([]uint64{1000, 2000, 1100})
+	first, second := <-done, <-done
+	// then
+	assert.False(t, first.IsZero())
+	assert.False(t, second.IsZero())
+}
+
+func Test_receive_detects_loss(t *testing.T) {
+	// given
+	conn := MIDINetworkStream{}
+	// when
+	first := conn.receive(0xfffe)
+	next := conn.receive(0xffff)
+	wrapped := conn.receive(0x0000)
+	lost := conn.receive(0x0002)
+	// then
+	assert.False(t, first)
+	assert.False(t, next)
+	assert.False(t, wrapped)
+	assert.True(t, lost)
+	assert.Equal(t, uint32(0x10002), conn.receivedSeqNum)
+}
+
+func Test_receive_ignores_old_messages(t *testing.T) {
+	// given
+	conn := MIDINetworkStream{}
+	conn.receive(10)
+	// when
+	duplicate := conn.receive(10)
+	reordered := conn.receive(9)
+	// then
+	assert.False(t, duplicate)
+	assert.False(t, reordered)
+	assert.Equal(t, uint32(10), conn.receivedSeqNum)
+}
+
+func Test_receiver_feedback_is_due_after_new_messages(t *testing.T) {
+	// given
+	now := time.Now()
+	conn := MIDINetworkStream{}
+	// then
+	assert.False(t, conn.receiverFeedbackDue(now))
+	conn.receive(1)
+	assert.True(t, conn.receiverFeedbackDue(now))
+}
@@ -0,0 +1,63 @@
+package session
+
+import (
+	"errors"
+	"net"
+)
+
+// Transport opens the ports of a session. The default transport listens on the
+// UDP ports of all local interfaces.
+type Transport interface {
+	// ListenPacket opens the given port. The port 0 opens an ephemeral port.
+	ListenPacket(port uint16) (net.PacketConn, error)
+}
+
+// UDPTransport listens on the UDP ports of a local IP address.
+type UDPTransport struct {
+	// IP is the local address, all interfaces are used if IP is nil.
+	IP net.IP
+	// Zone is the IPv6 scoped addressing zone, e.g. the interface name.
+	Zone string
+}
+
+// ListenPacket opens the UDP port on the local IP address.
+func (t UDPTransport) ListenPacket(port uint16) (net.PacketConn, error) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: t.IP, Port: int(port), Zone: t.Zone})
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// WithTransport sets the transport which opens the control and the MIDI port.
+func WithTransport(transport Transport) Option {
+	return func(s *MIDINetworkSession) {
+		s.transport = transport
+	}
+}
+
+// ErrInvalidPort is returned by Start when the control port is 65535, because
+// there is no following port for the MIDI port.
+var ErrInvalidPort = errors.New("invalid port")
+
+// ErrMissingPacketConn is returned by Start when only one of the ports was set
+// with WithPacketConns.
+var ErrMissingPacketConn = errors.New("missing packet conn")
+
+// WithPacketConns sets the already opened control and MIDI port. The transport
+// is not used and the ports are closed when the session is closed. Both ports
+// must be set.
+func WithPacketConns(control, midi net.PacketConn) Option {
+	return func(s *MIDINetworkSession) {
+		s.controlPc = control
+		s.midiPc = midi
+	}
+}
+
+// addrPort returns the port of a UDP address or 0 for other addresses.
+func addrPort(addr net.Addr) uint16 {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return uint16(udp.Port)
+	}
+	return 0
+}
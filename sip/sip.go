@@ -48,6 +48,12 @@ type ControlMessage struct {
 	SequenceNumber uint32
 }
 
+// IsControlMessage returns true if the buffer starts with the Apple MIDI control header.
+// It is used to separate control messages from RTP messages received on the same port.
+func IsControlMessage(buffer []byte) bool {
+	return len(buffer) >= 2 && binary.BigEndian.Uint16(buffer[0:2]) == header
+}
+
 // Decode a byte buffer into a ControlMessage
 func Decode(buffer []byte) (msg ControlMessage, err error) {
 	msg = ControlMessage{}
@@ -141,3 +141,9 @@ func Test_ReceiverFeedback_Codec(t *testing.T) {
 		0xbb, 0xbb, 0xbb, 0xbb, // Sequence number
 	}, buffer)
 }
+
+func Test_IsControlMessage(t *testing.T) {
+	assert.True(t, IsControlMessage([]byte{0xff, 0xff, 0x43, 0x4b}))
+	assert.False(t, IsControlMessage([]byte{0x80, 0x61, 0x00, 0x01}))
+	assert.False(t, IsControlMessage([]byte{0xff}))
+}
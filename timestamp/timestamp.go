@@ -1,6 +1,8 @@
 package timestamp
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"time"
 )
@@ -22,7 +24,11 @@ func Of(t time.Time, start time.Time) Timestamp {
 	return Timestamp(t.Sub(start).Nanoseconds() / int64(rate))
 }
 
-// EncodeDeltaTime writes the encoded delta time onto the writer
+// ErrDeltaTimeOverflow is returned when a delta time exceeds the four octet encoding.
+var ErrDeltaTimeOverflow = errors.New("delta time overflow")
+
+// EncodeDeltaTime writes the encoded delta time onto the writer.
+// Nothing is written if the delta time does not fit into four octets.
 /*
    One-Octet Delta Time:
 
@@ -45,13 +51,11 @@ func Of(t time.Time, start time.Time) Timestamp {
       Decoded form: 0000aaaa aaabbbbb bbcccccc cddddddd
 
 */
-func EncodeDeltaTime(reference time.Time, start time.Time, delta time.Duration, w io.Writer) {
+func EncodeDeltaTime(reference time.Time, start time.Time, delta time.Duration, w io.Writer) error {
 
 	ticks := Of(reference.Add(delta), start).Uint32() - Of(reference, start).Uint32()
 	if ticks >= 0x10000000 {
-		// FIXME pass through the error up to the client
-		// send the highest possible value
-		w.Write([]byte{0xff, 0xff, 0xff, 0x8f})
+		return fmt.Errorf("%w: %d ticks", ErrDeltaTimeOverflow, ticks)
 	} else if ticks >= 0x200000 {
 		low := byte(ticks & 0x7f)
 		byte2 := byte((ticks >> 7) | 0x80)
@@ -70,7 +74,52 @@ func EncodeDeltaTime(reference time.Time, start time.Time, delta time.Duration,
 	} else {
 		w.Write([]byte{byte(ticks)})
 	}
+	return nil
+}
+
+// ErrInvalidDeltaTime is returned when a delta time can not be decoded.
+var ErrInvalidDeltaTime = errors.New("invalid delta time")
+
+// DecodeDeltaTime reads an encoded delta time from the start of the buffer.
+// It returns the decoded delta time and the number of octets consumed.
+// See EncodeDeltaTime for the encoding.
+func DecodeDeltaTime(buffer []byte) (delta time.Duration, n int, err error) {
+	ticks := uint32(0)
+	for n < 4 {
+		if n >= len(buffer) {
+			return 0, n, ErrInvalidDeltaTime
+		}
+		b := buffer[n]
+		n++
+		ticks = ticks<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return time.Duration(ticks) * rate, n, nil
+		}
+	}
+	return 0, n, ErrInvalidDeltaTime
+}
+
+// Extend returns the 64 bit Timestamp of a 32 bit RTP timestamp which is closest
+// to the given reference.
+func Extend(ts uint32, reference Timestamp) Timestamp {
+	ext := Timestamp(uint64(reference)&^0xffffffff | uint64(ts))
+	switch {
+	case ext > reference && ext-reference > 0x80000000 && ext >= 0x100000000:
+		ext -= 0x100000000
+	case ext < reference && reference-ext > 0x80000000:
+		ext += 0x100000000
+	}
+	return ext
+}
+
+// Time returns the time of the Timestamp relative to the given start.
+func (ts Timestamp) Time(start time.Time) time.Time {
+	return start.Add(ts.Duration())
+}
 
+// Duration returns the duration since the session start.
+func (ts Timestamp) Duration() time.Duration {
+	return time.Duration(ts) * rate
 }
 
 // Uint64 returns the long representation of the Timesteamp
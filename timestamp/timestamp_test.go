@@ -2,6 +2,7 @@ package timestamp
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 	"time"
 
@@ -137,3 +138,63 @@ func Test_Encode_largest_three_four_DeltaTime(t *testing.T) {
 	// then
 	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0x7f}, b.Bytes())
 }
+
+func Test_Encode_overflowing_DeltaTime(t *testing.T) {
+	// given
+	b := new(bytes.Buffer)
+	start := time.Now()
+	reference := start.Add(tick)
+	delta := 0x10000000 * tick
+
+	// when
+	err := EncodeDeltaTime(reference, start, delta, b)
+	// then
+	assert.True(t, errors.Is(err, ErrDeltaTimeOverflow))
+	assert.Equal(t, 0, b.Len())
+}
+
+func Test_Decode_DeltaTime(t *testing.T) {
+	tests := []struct {
+		buffer []byte
+		delta  time.Duration
+		n      int
+	}{
+		{[]byte{0x7f, 0x00}, 0x7f * tick, 1},
+		{[]byte{0x81, 0x00}, 0x80 * tick, 2},
+		{[]byte{0xff, 0xff, 0x7f}, 0x1fffff * tick, 3},
+		{[]byte{0xff, 0xff, 0xff, 0x7f}, 0x0fffffff * tick, 4},
+	}
+	for _, tt := range tests {
+		// when
+		delta, n, err := DecodeDeltaTime(tt.buffer)
+		// then
+		assert.Nil(t, err)
+		assert.Equal(t, tt.delta, delta)
+		assert.Equal(t, tt.n, n)
+	}
+}
+
+func Test_Decode_invalid_DeltaTime(t *testing.T) {
+	// when
+	_, _, truncated := DecodeDeltaTime([]byte{0x81})
+	_, _, tooLong := DecodeDeltaTime([]byte{0x81, 0x81, 0x81, 0x81, 0x00})
+	// then
+	assert.Equal(t, ErrInvalidDeltaTime, truncated)
+	assert.Equal(t, ErrInvalidDeltaTime, tooLong)
+}
+
+func Test_Time(t *testing.T) {
+	// given
+	start := time.Now()
+	// when
+	actual := Timestamp(10).Time(start)
+	// then
+	assert.Equal(t, start.Add(10*tick), actual)
+}
+
+func Test_Extend(t *testing.T) {
+	assert.Equal(t, Timestamp(0x100000010), Extend(0x10, Timestamp(0xfffffff0)))
+	assert.Equal(t, Timestamp(0xfffffff0), Extend(0xfffffff0, Timestamp(0x100000010)))
+	assert.Equal(t, Timestamp(0x200000005), Extend(0x05, Timestamp(0x200000000)))
+	assert.Equal(t, Timestamp(0xfffffff0), Extend(0xfffffff0, Timestamp(0x10)))
+}